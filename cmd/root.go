@@ -16,9 +16,12 @@
 package cmd
 
 import (
+	"encoding/base64"
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/itskingori/sanaa/service"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
@@ -53,11 +56,43 @@ func init() {
 	RootCmd.PersistentFlags().String("redis-host", "127.0.0.1", "host of redis server")
 	RootCmd.PersistentFlags().Int("redis-port", 6379, "port of redis server")
 	RootCmd.PersistentFlags().String("redis-namespace", "sanaa", "namespace to use when storing data in redis server")
+	RootCmd.PersistentFlags().String("storage", service.S3Storage, fmt.Sprintf("storage backend to keep rendered files in i.e. %s", strings.Join(service.StorageBackends, ", ")))
+	RootCmd.PersistentFlags().String("filesystem-path", "", "directory shared by the server and worker to keep rendered files in, required by the filesystem storage backend")
+	RootCmd.PersistentFlags().String("s3-endpoint", "", "endpoint of an S3 compatible service to use instead of AWS S3 e.g. MinIO or Ceph RGW")
+	RootCmd.PersistentFlags().String("s3-region", "", "region of the S3 bucket, overrides the region picked from AWS configuration")
+	RootCmd.PersistentFlags().Bool("s3-force-path-style", false, "use path-style addressing (endpoint/bucket/key) for S3 requests")
+	RootCmd.PersistentFlags().String("s3-access-key-id", "", "static access key ID to use with S3, overrides the credentials picked from AWS configuration")
+	RootCmd.PersistentFlags().String("s3-secret-access-key", "", "static secret access key to use with S3, required if --s3-access-key-id is set")
+	RootCmd.PersistentFlags().String("s3-sse", service.S3EncryptionNone, fmt.Sprintf("server-side encryption to apply to files stored in S3 i.e. %s", strings.Join(service.S3EncryptionModes, ", ")))
+	RootCmd.PersistentFlags().String("s3-sse-kms-key-id", "", "ID of the AWS KMS key to encrypt files with when using sse-kms, defaults to the AWS managed key")
+	RootCmd.PersistentFlags().String("s3-sse-customer-key", "", "base64 encoded 256-bit key to encrypt files with when using sse-c")
+	RootCmd.PersistentFlags().StringSlice("source-allowed-schemes", []string{"http", "https"}, "schemes that source URLs are allowed to have")
+	RootCmd.PersistentFlags().StringSlice("source-allowed-hosts", []string{}, "hosts that source URLs are allowed to have e.g. example.com or *.example.com, any host is allowed if not set")
+	RootCmd.PersistentFlags().StringSlice("source-denied-hosts", []string{}, "hosts that source URLs are not allowed to have e.g. example.com or *.example.com")
+	RootCmd.PersistentFlags().StringSlice("source-allowed-cidrs", []string{}, "CIDR blocks that hosts of source URLs are allowed to resolve to, including private ones, any public address is allowed if not set")
+	RootCmd.PersistentFlags().StringSlice("source-denied-cidrs", []string{}, "CIDR blocks that hosts of source URLs are not allowed to resolve to")
+	RootCmd.PersistentFlags().Bool("source-allow-private", false, "allow hosts of source URLs to resolve to private, loopback and link-local addresses")
 
 	// Bind RootCmd flags with viper configuration
 	viper.BindPFlag("redis.host", RootCmd.PersistentFlags().Lookup("redis-host"))
 	viper.BindPFlag("redis.port", RootCmd.PersistentFlags().Lookup("redis-port"))
 	viper.BindPFlag("redis.namespace", RootCmd.PersistentFlags().Lookup("redis-namespace"))
+	viper.BindPFlag("storage.backend", RootCmd.PersistentFlags().Lookup("storage"))
+	viper.BindPFlag("storage.filesystem_path", RootCmd.PersistentFlags().Lookup("filesystem-path"))
+	viper.BindPFlag("storage.s3_endpoint", RootCmd.PersistentFlags().Lookup("s3-endpoint"))
+	viper.BindPFlag("storage.s3_region", RootCmd.PersistentFlags().Lookup("s3-region"))
+	viper.BindPFlag("storage.s3_force_path_style", RootCmd.PersistentFlags().Lookup("s3-force-path-style"))
+	viper.BindPFlag("storage.s3_access_key_id", RootCmd.PersistentFlags().Lookup("s3-access-key-id"))
+	viper.BindPFlag("storage.s3_secret_access_key", RootCmd.PersistentFlags().Lookup("s3-secret-access-key"))
+	viper.BindPFlag("storage.s3_sse", RootCmd.PersistentFlags().Lookup("s3-sse"))
+	viper.BindPFlag("storage.s3_sse_kms_key_id", RootCmd.PersistentFlags().Lookup("s3-sse-kms-key-id"))
+	viper.BindPFlag("storage.s3_sse_customer_key", RootCmd.PersistentFlags().Lookup("s3-sse-customer-key"))
+	viper.BindPFlag("source.allowed_schemes", RootCmd.PersistentFlags().Lookup("source-allowed-schemes"))
+	viper.BindPFlag("source.allowed_hosts", RootCmd.PersistentFlags().Lookup("source-allowed-hosts"))
+	viper.BindPFlag("source.denied_hosts", RootCmd.PersistentFlags().Lookup("source-denied-hosts"))
+	viper.BindPFlag("source.allowed_cidrs", RootCmd.PersistentFlags().Lookup("source-allowed-cidrs"))
+	viper.BindPFlag("source.denied_cidrs", RootCmd.PersistentFlags().Lookup("source-denied-cidrs"))
+	viper.BindPFlag("source.allow_private", RootCmd.PersistentFlags().Lookup("source-allow-private"))
 }
 
 // initConfig applies initial configuration
@@ -68,3 +103,96 @@ func initConfig() {
 		log.SetLevel(log.InfoLevel)
 	}
 }
+
+// validateStorage validates the storage flag
+func validateStorage(cmd *cobra.Command) error {
+	sv, _ := cmd.Flags().GetString("storage")
+
+	for _, backend := range service.StorageBackends {
+		if sv == backend {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("set storage is '%s', yet the supported backends are %s", sv, strings.Join(service.StorageBackends, ", "))
+}
+
+// validateStorageFilesystemPath validates the filesystem-path flag
+func validateStorageFilesystemPath(cmd *cobra.Command) error {
+	sv, _ := cmd.Flags().GetString("storage")
+	fpv, _ := cmd.Flags().GetString("filesystem-path")
+
+	if sv == service.FilesystemStorage && fpv == "" {
+		return fmt.Errorf("the filesystem path cannot be empty, set --filesystem-path")
+	}
+
+	return nil
+}
+
+// validateStorageS3Credentials validates the s3-access-key-id and
+// s3-secret-access-key flags
+func validateStorageS3Credentials(cmd *cobra.Command) error {
+	akv, _ := cmd.Flags().GetString("s3-access-key-id")
+	skv, _ := cmd.Flags().GetString("s3-secret-access-key")
+
+	if (akv == "") != (skv == "") {
+		return fmt.Errorf("static S3 credentials are incomplete, set both --s3-access-key-id and --s3-secret-access-key")
+	}
+
+	return nil
+}
+
+// validateStorageS3Encryption validates the s3-sse* flags
+func validateStorageS3Encryption(cmd *cobra.Command) error {
+	sv, _ := cmd.Flags().GetString("s3-sse")
+	ckv, _ := cmd.Flags().GetString("s3-sse-customer-key")
+
+	supported := false
+	for _, mode := range service.S3EncryptionModes {
+		if sv == mode {
+			supported = true
+		}
+	}
+
+	if !supported {
+		return fmt.Errorf("set s3-sse is '%s', yet the supported modes are %s", sv, strings.Join(service.S3EncryptionModes, ", "))
+	}
+
+	if sv != service.S3EncryptionCustomer {
+		return nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(ckv)
+	if err != nil {
+		return fmt.Errorf("the S3 SSE-C key is not valid base64, check --s3-sse-customer-key")
+	}
+
+	if len(key) != service.S3EncryptionCustomerKeySize {
+		return fmt.Errorf("the S3 SSE-C key is %d bytes, yet it should be %d bytes, check --s3-sse-customer-key", len(key), service.S3EncryptionCustomerKeySize)
+	}
+
+	return nil
+}
+
+// validateSourcePolicy validates the source-* flags
+func validateSourcePolicy(cmd *cobra.Command) error {
+	schemes, _ := cmd.Flags().GetStringSlice("source-allowed-schemes")
+	acv, _ := cmd.Flags().GetStringSlice("source-allowed-cidrs")
+	dcv, _ := cmd.Flags().GetStringSlice("source-denied-cidrs")
+
+	if len(schemes) == 0 {
+		return fmt.Errorf("no source URL schemes are allowed, set --source-allowed-schemes")
+	}
+
+	_, err := service.ParseCIDRs(acv)
+	if err != nil {
+		return fmt.Errorf("%v, check --source-allowed-cidrs", err)
+	}
+
+	_, err = service.ParseCIDRs(dcv)
+	if err != nil {
+		return fmt.Errorf("%v, check --source-denied-cidrs", err)
+	}
+
+	return nil
+}
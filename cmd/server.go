@@ -39,6 +39,90 @@ var serverCmd = &cobra.Command{
 			return err
 		}
 
+		err = validateServerURLTTL(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerMaxHTMLSize(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerMaxBundleSize(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerMaxRequestSize(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerMaxWait(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerMaxBatchSize(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerCallback(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerConversionTimeout(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorage(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateSourcePolicy(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorageFilesystemPath(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorageS3Credentials(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorageS3Encryption(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateServerFileURLSecret(cmd)
+		if err != nil {
+
+			return err
+		}
+
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -57,11 +141,41 @@ func init() {
 	serverCmd.PersistentFlags().String("binding-address", "0.0.0.0", "address to bind to and listen for requests")
 	serverCmd.PersistentFlags().Int("binding-port", 8080, "port to bind to and listen for requests")
 	serverCmd.PersistentFlags().Int("request-ttl", 86400, "how long to keep requests and their data, in seconds")
+	serverCmd.PersistentFlags().Int("url-ttl", 300, "how long URLs to rendered files are valid for by default, in seconds")
+	serverCmd.PersistentFlags().Int("max-url-ttl", 86400, "the maximum url_ttl that a render request can set, in seconds")
+	serverCmd.PersistentFlags().Int("max-html-size", 5242880, "the maximum size of inline HTML sources of render requests, in bytes")
+	serverCmd.PersistentFlags().Int("max-bundle-size", 20971520, "the maximum size of uploaded HTML bundles, in bytes")
+	serverCmd.PersistentFlags().Int("max-request-size", 10485760, "the maximum size of the JSON body of render requests, in bytes")
+	serverCmd.PersistentFlags().Int("max-wait", 60, "the maximum time render requests can wait for their job to finish, in seconds")
+	serverCmd.PersistentFlags().Int("max-batch-size", 1000, "the maximum number of render requests in a batch")
+	serverCmd.PersistentFlags().Int("conversion-timeout", 120, "how long conversions are allowed to run for by default, in seconds")
+	serverCmd.PersistentFlags().Int("max-conversion-timeout", 600, "the maximum timeout that a render request can set, in seconds")
+	serverCmd.PersistentFlags().String("callback-secret", "", "secret used to sign callbacks of render requests, callbacks aren't signed if it's empty")
+	serverCmd.PersistentFlags().Int("callback-max-attempts", 5, "the maximum number of times delivery of a callback is attempted")
+	serverCmd.PersistentFlags().Int("callback-timeout", 10, "how long to wait for a response to a callback, in seconds")
+	serverCmd.PersistentFlags().String("external-url", "", "base URL the server is reachable at, used to build links to files served by the server")
+	serverCmd.PersistentFlags().String("file-url-secret", "", "secret used to sign links to files served by the server, required by the filesystem storage backend")
+	serverCmd.PersistentFlags().StringSlice("allowed-destinations", []string{}, "storage destinations (container/prefix) that render requests are allowed to store files in")
 
 	// Bind serverCmd flags with viper configuration
 	viper.BindPFlag("server.binding_address", serverCmd.PersistentFlags().Lookup("binding-address"))
 	viper.BindPFlag("server.binding_port", serverCmd.PersistentFlags().Lookup("binding-port"))
 	viper.BindPFlag("server.request_ttl", serverCmd.PersistentFlags().Lookup("request-ttl"))
+	viper.BindPFlag("server.url_ttl", serverCmd.PersistentFlags().Lookup("url-ttl"))
+	viper.BindPFlag("server.max_url_ttl", serverCmd.PersistentFlags().Lookup("max-url-ttl"))
+	viper.BindPFlag("server.max_html_size", serverCmd.PersistentFlags().Lookup("max-html-size"))
+	viper.BindPFlag("server.max_bundle_size", serverCmd.PersistentFlags().Lookup("max-bundle-size"))
+	viper.BindPFlag("server.max_request_size", serverCmd.PersistentFlags().Lookup("max-request-size"))
+	viper.BindPFlag("server.max_wait", serverCmd.PersistentFlags().Lookup("max-wait"))
+	viper.BindPFlag("server.max_batch_size", serverCmd.PersistentFlags().Lookup("max-batch-size"))
+	viper.BindPFlag("server.conversion_timeout", serverCmd.PersistentFlags().Lookup("conversion-timeout"))
+	viper.BindPFlag("server.max_conversion_timeout", serverCmd.PersistentFlags().Lookup("max-conversion-timeout"))
+	viper.BindPFlag("server.callback_secret", serverCmd.PersistentFlags().Lookup("callback-secret"))
+	viper.BindPFlag("server.callback_max_attempts", serverCmd.PersistentFlags().Lookup("callback-max-attempts"))
+	viper.BindPFlag("server.callback_timeout", serverCmd.PersistentFlags().Lookup("callback-timeout"))
+	viper.BindPFlag("server.external_url", serverCmd.PersistentFlags().Lookup("external-url"))
+	viper.BindPFlag("server.file_url_secret", serverCmd.PersistentFlags().Lookup("file-url-secret"))
+	viper.BindPFlag("server.allowed_destinations", serverCmd.PersistentFlags().Lookup("allowed-destinations"))
 }
 
 // validateServerRequestTTL validates the request-ttl flag
@@ -74,3 +188,130 @@ func validateServerRequestTTL(cmd *cobra.Command) error {
 
 	return nil
 }
+
+// validateServerURLTTL validates the url-ttl and max-url-ttl flags
+func validateServerURLTTL(cmd *cobra.Command) error {
+	ut, _ := cmd.Flags().GetInt("url-ttl")
+	mut, _ := cmd.Flags().GetInt("max-url-ttl")
+
+	if ut < service.MinURLTTL {
+		return fmt.Errorf("set url-ttl is %d, yet the minimum is %d", ut, service.MinURLTTL)
+	}
+
+	if mut < ut {
+		return fmt.Errorf("set max-url-ttl is %d, yet the minimum is the url-ttl of %d", mut, ut)
+	}
+
+	if mut > service.MaxURLTTL {
+		return fmt.Errorf("set max-url-ttl is %d, yet the maximum is %d", mut, service.MaxURLTTL)
+	}
+
+	return nil
+}
+
+// validateServerMaxHTMLSize validates the max-html-size flag
+func validateServerMaxHTMLSize(cmd *cobra.Command) error {
+	mhs, _ := cmd.Flags().GetInt("max-html-size")
+
+	if mhs < service.MinMaxHTMLSize {
+		return fmt.Errorf("set max-html-size is %d, yet the minimum is %d", mhs, service.MinMaxHTMLSize)
+	}
+
+	return nil
+}
+
+// validateServerMaxBundleSize validates the max-bundle-size flag
+func validateServerMaxBundleSize(cmd *cobra.Command) error {
+	mbs, _ := cmd.Flags().GetInt("max-bundle-size")
+
+	if mbs < service.MinMaxBundleSize {
+		return fmt.Errorf("set max-bundle-size is %d, yet the minimum is %d", mbs, service.MinMaxBundleSize)
+	}
+
+	return nil
+}
+
+// validateServerMaxRequestSize validates the max-request-size flag, requests
+// have to be able to carry inline HTML of the maximum size
+func validateServerMaxRequestSize(cmd *cobra.Command) error {
+	mrs, _ := cmd.Flags().GetInt("max-request-size")
+	mhs, _ := cmd.Flags().GetInt("max-html-size")
+
+	if mrs < mhs {
+		return fmt.Errorf("set max-request-size is %d, yet the minimum is the max-html-size of %d", mrs, mhs)
+	}
+
+	return nil
+}
+
+// validateServerMaxWait validates the max-wait flag
+func validateServerMaxWait(cmd *cobra.Command) error {
+	mwv, _ := cmd.Flags().GetInt("max-wait")
+
+	if mwv < service.MinMaxWait {
+		return fmt.Errorf("set max-wait is %d, yet the minimum is %d", mwv, service.MinMaxWait)
+	}
+
+	return nil
+}
+
+// validateServerMaxBatchSize validates the max-batch-size flag
+func validateServerMaxBatchSize(cmd *cobra.Command) error {
+	mbs, _ := cmd.Flags().GetInt("max-batch-size")
+
+	if mbs < service.MinMaxBatchSize {
+		return fmt.Errorf("set max-batch-size is %d, yet the minimum is %d", mbs, service.MinMaxBatchSize)
+	}
+
+	return nil
+}
+
+// validateServerConversionTimeout validates the conversion-timeout and
+// max-conversion-timeout flags
+func validateServerConversionTimeout(cmd *cobra.Command) error {
+	ct, _ := cmd.Flags().GetInt("conversion-timeout")
+	mct, _ := cmd.Flags().GetInt("max-conversion-timeout")
+
+	if ct < service.MinConversionTimeout {
+		return fmt.Errorf("set conversion-timeout is %d, yet the minimum is %d", ct, service.MinConversionTimeout)
+	}
+
+	if mct < ct {
+		return fmt.Errorf("set max-conversion-timeout is %d, yet the minimum is the conversion-timeout of %d", mct, ct)
+	}
+
+	if mct > service.MaxConversionTimeout {
+		return fmt.Errorf("set max-conversion-timeout is %d, yet the maximum is %d", mct, service.MaxConversionTimeout)
+	}
+
+	return nil
+}
+
+// validateServerCallback validates the callback-max-attempts and
+// callback-timeout flags
+func validateServerCallback(cmd *cobra.Command) error {
+	cma, _ := cmd.Flags().GetInt("callback-max-attempts")
+	ctv, _ := cmd.Flags().GetInt("callback-timeout")
+
+	if cma < service.MinCallbackMaxAttempts {
+		return fmt.Errorf("set callback-max-attempts is %d, yet the minimum is %d", cma, service.MinCallbackMaxAttempts)
+	}
+
+	if ctv < service.MinCallbackTimeout {
+		return fmt.Errorf("set callback-timeout is %d, yet the minimum is %d", ctv, service.MinCallbackTimeout)
+	}
+
+	return nil
+}
+
+// validateServerFileURLSecret validates the file-url-secret flag
+func validateServerFileURLSecret(cmd *cobra.Command) error {
+	sv, _ := cmd.Flags().GetString("storage")
+	fusv, _ := cmd.Flags().GetString("file-url-secret")
+
+	if sv == service.FilesystemStorage && fusv == "" {
+		return fmt.Errorf("the file URL secret cannot be empty, set --file-url-secret")
+	}
+
+	return nil
+}
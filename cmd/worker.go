@@ -19,6 +19,7 @@ import (
 	"fmt"
 
 	"github.com/itskingori/sanaa/service"
+	"github.com/robfig/cron"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
@@ -45,12 +46,54 @@ var workerCmd = &cobra.Command{
 			return err
 		}
 
+		err = validateStorage(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateSourcePolicy(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorageFilesystemPath(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorageS3Credentials(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateStorageS3Encryption(cmd)
+		if err != nil {
+
+			return err
+		}
+
 		err = validateWorkerS3Bucket(cmd)
 		if err != nil {
 
 			return err
 		}
 
+		err = validateWorkerS3Upload(cmd)
+		if err != nil {
+
+			return err
+		}
+
+		err = validateWorkerCleanupSchedule(cmd)
+		if err != nil {
+
+			return err
+		}
+
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -68,15 +111,22 @@ func init() {
 	// Add flags to workerCmd
 	workerCmd.PersistentFlags().Int("concurrency", 2, "number of conversion jobs that can be processed at a time, maximum is 10")
 	workerCmd.PersistentFlags().Int("max-retries", 1, "maximum number of times to retry a job on failure")
-	workerCmd.PersistentFlags().String("s3-bucket", "", "the name of the S3 bucket to use when storing rendered files ")
-
-	// Configure required flags
-	workerCmd.MarkFlagRequired("s3-bucket")
+	workerCmd.PersistentFlags().String("s3-bucket", "", "the name of the S3 bucket to use when storing rendered files, required by the s3 storage backend")
+	workerCmd.PersistentFlags().Int("s3-upload-part-size", 5, "size of each part of a multipart upload to S3, in megabytes, minimum is 5")
+	workerCmd.PersistentFlags().Int("s3-upload-concurrency", 5, "number of parts of a multipart upload to S3 to upload at a time")
+	workerCmd.PersistentFlags().Int("s3-upload-timeout", 300, "how long to wait for an upload to S3 to complete, in seconds")
+	workerCmd.PersistentFlags().Int("s3-upload-part-retries", 3, "maximum number of times to retry uploading a part to S3 on failure")
+	workerCmd.PersistentFlags().String("cleanup-schedule", "0 */5 * * * *", "cron schedule (with seconds) on which to delete stored files of expired jobs")
 
 	// Bind workerCmd flags with viper configuration
 	viper.BindPFlag("worker.concurrency", workerCmd.PersistentFlags().Lookup("concurrency"))
 	viper.BindPFlag("worker.max-retries", workerCmd.PersistentFlags().Lookup("max-retries"))
 	viper.BindPFlag("worker.s3_bucket", workerCmd.PersistentFlags().Lookup("s3-bucket"))
+	viper.BindPFlag("worker.s3_upload_part_size", workerCmd.PersistentFlags().Lookup("s3-upload-part-size"))
+	viper.BindPFlag("worker.s3_upload_concurrency", workerCmd.PersistentFlags().Lookup("s3-upload-concurrency"))
+	viper.BindPFlag("worker.s3_upload_timeout", workerCmd.PersistentFlags().Lookup("s3-upload-timeout"))
+	viper.BindPFlag("worker.s3_upload_part_retries", workerCmd.PersistentFlags().Lookup("s3-upload-part-retries"))
+	viper.BindPFlag("worker.cleanup_schedule", workerCmd.PersistentFlags().Lookup("cleanup-schedule"))
 }
 
 // validateWorkerConcurrency validate the concurrency flag
@@ -107,11 +157,50 @@ func validateWorkerMaxRetries(cmd *cobra.Command) error {
 
 // validateWorkerS3Bucket validate the s3-bucket flag
 func validateWorkerS3Bucket(cmd *cobra.Command) error {
+	sv, _ := cmd.Flags().GetString("storage")
 	sbv, _ := cmd.Flags().GetString("s3-bucket")
 
-	if sbv == "" {
+	if sv == service.S3Storage && sbv == "" {
 		return fmt.Errorf("the S3 bucket name cannot be empty, set --s3-bucket")
 	}
 
 	return nil
 }
+
+// validateWorkerS3Upload validate the s3-upload-* flags
+func validateWorkerS3Upload(cmd *cobra.Command) error {
+	psv, _ := cmd.Flags().GetInt("s3-upload-part-size")
+	cv, _ := cmd.Flags().GetInt("s3-upload-concurrency")
+	tv, _ := cmd.Flags().GetInt("s3-upload-timeout")
+	prv, _ := cmd.Flags().GetInt("s3-upload-part-retries")
+
+	if psv < service.MinS3UploadPartSize {
+		return fmt.Errorf("set s3-upload-part-size is %d, yet the minimum is %d", psv, service.MinS3UploadPartSize)
+	}
+
+	if cv < service.MinS3UploadConcurrency {
+		return fmt.Errorf("set s3-upload-concurrency is %d, yet the minimum is %d", cv, service.MinS3UploadConcurrency)
+	}
+
+	if tv < service.MinS3UploadTimeout {
+		return fmt.Errorf("set s3-upload-timeout is %d, yet the minimum is %d", tv, service.MinS3UploadTimeout)
+	}
+
+	if prv < service.MinS3UploadPartRetries {
+		return fmt.Errorf("set s3-upload-part-retries is %d, yet the minimum is %d", prv, service.MinS3UploadPartRetries)
+	}
+
+	return nil
+}
+
+// validateWorkerCleanupSchedule validate the cleanup-schedule flag
+func validateWorkerCleanupSchedule(cmd *cobra.Command) error {
+	csv, _ := cmd.Flags().GetString("cleanup-schedule")
+
+	_, err := cron.Parse(csv)
+	if err != nil {
+		return fmt.Errorf("set cleanup-schedule '%s' is invalid, %s", csv, err)
+	}
+
+	return nil
+}
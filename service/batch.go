@@ -0,0 +1,877 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gocraft/work"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	archiveQueue = "archive"
+
+	// MinMaxBatchSize is the minimum that the maximum number of render
+	// requests in a batch can be set to
+	MinMaxBatchSize = 1
+
+	// batchArchiveFile is the name of the archive of the rendered files of a
+	// batch
+	batchArchiveFile = "batch.zip"
+
+	// batchManifestFile is the name of the file in the archive of a batch that
+	// lists its jobs
+	batchManifestFile = "manifest.json"
+)
+
+// Batch is a mapping of a batch's attributes, a batch is a group of conversion
+// jobs submitted together
+type Batch struct {
+	Identifier      string `redis:"uuid"`
+	CreatedAt       string `redis:"created_at"`
+	ExpiresIn       int    `redis:"expires_in"`
+	Size            int    `redis:"size"`
+	Archive         bool   `redis:"archive"`
+	ArchiveStatus   string `redis:"archive_status"`
+	ArchiveLocation string `redis:"archive_location"`
+	ArchiveError    string `redis:"archive_error"`
+}
+
+// batchRequest is a render request of a batch, of either target
+type batchRequest struct {
+	Type    string          `json:"type"`
+	Request json.RawMessage `json:"request"`
+}
+
+type batchRenderRequest struct {
+	Requests []batchRequest `json:"requests"`
+	Archive  bool           `json:"archive"`
+}
+
+type batchArchiveResponse struct {
+	Status           string `json:"status"`
+	FileURL          string `json:"file_url"`
+	FileURLExpiresAt string `json:"file_url_expires_at"`
+	Error            string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Identifier string                `json:"uuid"`
+	CreatedAt  string                `json:"created_at"`
+	ExpiresIn  int                   `json:"expires_in"`
+	Status     string                `json:"status"`
+	Total      int                   `json:"total"`
+	Counts     map[string]int        `json:"counts"`
+	Jobs       []string              `json:"jobs"`
+	Archive    *batchArchiveResponse `json:"archive,omitempty"`
+}
+
+// batchManifestEntry describes a job of a batch in the manifest of its archive
+type batchManifestEntry struct {
+	Identifier string `json:"uuid"`
+	Status     string `json:"status"`
+	File       string `json:"file,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func generateBatchKey(bid string) string {
+	key := fmt.Sprintf("%s:batch:%s", viper.GetString("redis.namespace"), bid)
+
+	return key
+}
+
+func generateBatchJobsKey(bid string) string {
+	key := fmt.Sprintf("%s:batch:%s:jobs", viper.GetString("redis.namespace"), bid)
+
+	return key
+}
+
+func generateBatchFinishedKey(bid string) string {
+	key := fmt.Sprintf("%s:batch:%s:finished", viper.GetString("redis.namespace"), bid)
+
+	return key
+}
+
+// archiveJob returns a conversion job standing in for the archive of the
+// batch, so that the archive can be stored, located and cleaned up like the
+// rendered files of jobs
+func (b *Batch) archiveJob() ConversionJob {
+	return ConversionJob{
+		Identifier:      b.Identifier,
+		CreatedAt:       b.CreatedAt,
+		ExpiresIn:       b.ExpiresIn,
+		RequestType:     "batch",
+		StorageLocation: b.ArchiveLocation,
+	}
+}
+
+func (clt *Client) createBatch(bid string, size int, archive bool) (Batch, error) {
+	rt := viper.GetInt("server.request_ttl")
+	b := Batch{
+		Identifier: bid,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339),
+		ExpiresIn:  rt,
+		Size:       size,
+		Archive:    archive,
+	}
+	if archive {
+		b.ArchiveStatus = "pending"
+	}
+
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	key := generateBatchKey(bid)
+	_, err := conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(&b)...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": bid,
+		}).Error("error saving batch")
+
+		return b, err
+	}
+
+	_, err = conn.Do("EXPIRE", key, rt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": bid,
+		}).Error("error setting batch expiry")
+
+		return b, err
+	}
+
+	return b, nil
+}
+
+// addBatchJob adds the conversion job to the batch, it has to be added before
+// the job is enqueued
+func (clt *Client) addBatchJob(b *Batch, jid string) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	key := generateBatchJobsKey(b.Identifier)
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, jid)
+	conn.Send("EXPIRE", key, b.ExpiresIn)
+	_, err := conn.Do("EXEC")
+
+	return err
+}
+
+// discardBatch deletes a batch that couldn't be submitted as a whole along with
+// the conversion jobs passed in, which mustn't have been enqueued. Their entries
+// in the job indexes are pruned as they expire
+func (clt *Client) discardBatch(b *Batch, cjs []ConversionJob) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	keys := redis.Args{}.Add(
+		generateBatchKey(b.Identifier),
+		generateBatchJobsKey(b.Identifier),
+		generateBatchFinishedKey(b.Identifier),
+	)
+	for i := range cjs {
+		keys = keys.Add(generateJobKey(cjs[i].Identifier))
+	}
+
+	_, err := conn.Do("DEL", keys...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": b.Identifier,
+		}).Errorf("error discarding batch: %v", err)
+
+		return err
+	}
+
+	return nil
+}
+
+func (clt *Client) fetchBatch(bid string) (Batch, bool, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	b := Batch{}
+
+	value, err := redis.Values(conn.Do("HGETALL", generateBatchKey(bid)))
+	if err != nil {
+		return b, false, err
+	}
+
+	if len(value) == 0 {
+		return b, false, nil
+	}
+
+	err = redis.ScanStruct(value, &b)
+	if err != nil {
+		return b, false, err
+	}
+
+	return b, true, nil
+}
+
+func (clt *Client) updateBatch(b *Batch) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HMSET", redis.Args{}.Add(generateBatchKey(b.Identifier)).AddFlat(b)...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": b.Identifier,
+		}).Error("error saving batch changes")
+
+		return err
+	}
+
+	return nil
+}
+
+func (clt *Client) fetchBatchJobs(bid string) ([]string, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("LRANGE", generateBatchJobsKey(bid), 0, -1))
+}
+
+// finishBatchJob records that a conversion job of a batch finished, the
+// archive of the batch is enqueued once all of them have. Jobs are kept in a
+// set so that finishing one more than once e.g. when a running job is
+// cancelled, isn't counted twice
+func (clt *Client) finishBatchJob(cj *ConversionJob) error {
+	b, found, err := clt.fetchBatch(cj.Batch)
+	if err != nil || !found {
+		return err
+	}
+
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	key := generateBatchFinishedKey(b.Identifier)
+	conn.Send("MULTI")
+	conn.Send("SADD", key, cj.Identifier)
+	conn.Send("SCARD", key)
+	conn.Send("EXPIRE", key, b.ExpiresIn)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid":  cj.Identifier,
+			"batch": b.Identifier,
+		}).Error("error recording finished batch job")
+
+		return err
+	}
+
+	added, _ := redis.Int(values[0], nil)
+	finished, _ := redis.Int(values[1], nil)
+	if added == 0 || finished < b.Size {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"batch": b.Identifier,
+	}).Info("all jobs of batch finished")
+
+	if !b.Archive {
+		return nil
+	}
+
+	_, err = clt.enqueuer.Enqueue(archiveQueue, work.Q{"batch": b.Identifier})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": b.Identifier,
+		}).Errorf("error enqueueing batch archive: %v", err)
+
+		return err
+	}
+
+	return nil
+}
+
+// fetchBatchFile copies the rendered file of the conversion job from storage to
+// a temporary file in dir, so that a file that can't be read doesn't leave a
+// partial entry in the archive. It returns the path of the copy and the name
+// of the file in the archive
+func (cl *Client) fetchBatchFile(cj *ConversionJob, backend string, dir string) (string, string, error) {
+	_, key, err := parseStorageLocation(backend, cj.StorageLocation)
+	if err != nil {
+		return "", "", err
+	}
+	name := path.Join(cj.Identifier, path.Base(key))
+
+	reader, _, err := cl.storage.Open(cj)
+	if err != nil {
+		return "", "", err
+	}
+	defer reader.Close()
+
+	f, err := ioutil.TempFile(dir, cj.Identifier)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		os.Remove(f.Name())
+
+		return "", "", err
+	}
+
+	return f.Name(), name, nil
+}
+
+// addBatchFile adds the rendered file of the conversion job to the archive and
+// its name to the entry of the job in the manifest. Files that can't be
+// fetched are left out and recorded in the entry instead, only failing to
+// write the archive is returned
+func (cl *Client) addBatchFile(zw *zip.Writer, cj *ConversionJob, entry *batchManifestEntry, backend string, dir string) error {
+	filePath, name, err := cl.fetchBatchFile(cj, backend, dir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid":  cj.Identifier,
+			"batch": cj.Batch,
+		}).Warnf("leaving rendered file out of batch archive: %v", err)
+		entry.Error = "unable to fetch rendered file"
+
+		return nil
+	}
+	defer os.Remove(filePath)
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	entry.File = name
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
+
+// writeBatchArchive writes the rendered files of the succeeded jobs of the
+// batch to a ZIP archive, along with a manifest of all its jobs
+func (cl *Client) writeBatchArchive(b *Batch, archivePath string) error {
+	jids, err := cl.fetchBatchJobs(b.Identifier)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	manifest := []batchManifestEntry{}
+	backend := viper.GetString("storage.backend")
+
+	for _, jid := range jids {
+		cj, found, err := cl.fetchConversionJob(jid)
+		if err != nil {
+			return err
+		}
+
+		entry := batchManifestEntry{Identifier: jid, Status: "expired"}
+		if found {
+			entry.Status = cj.Status
+		}
+
+		if found && cj.Status == "succeeded" {
+			err = cl.addBatchFile(zw, &cj, &entry, backend, filepath.Dir(archivePath))
+			if err != nil {
+				return err
+			}
+		}
+
+		manifest = append(manifest, entry)
+	}
+
+	w, err := zw.Create(batchManifestFile)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(manifest)
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// storeBatchArchive builds the archive of the batch and stores it
+func (cl *Client) storeBatchArchive(b *Batch) error {
+	workDir, err := ioutil.TempDir("", b.Identifier)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	archivePath := filepath.Join(workDir, batchArchiveFile)
+	err = cl.writeBatchArchive(b, archivePath)
+	if err != nil {
+		return err
+	}
+
+	aj := b.archiveJob()
+	obj := generateStorageObject(&aj, &output{}, archivePath, batchArchiveFile)
+	key, err := generateStorageKey("", "", newStorageKeyData(&aj, batchArchiveFile))
+	if err != nil {
+		return err
+	}
+
+	aj.StorageLocation, err = cl.storage.Put(&aj, "", key, archivePath, obj)
+	if err != nil {
+		return err
+	}
+	b.ArchiveLocation = aj.StorageLocation
+
+	// Keep track of the stored archive so that it's cleaned up when the batch
+	// expires
+	return cl.trackStoredFile(&aj)
+}
+
+func (ctx *workerContext) archive(job *work.Job) error {
+	cl := NewClient()
+
+	bid := job.ArgString("batch")
+	log.WithFields(log.Fields{
+		"batch": bid,
+	}).Info("picked up batch archive job from queue")
+
+	b, found, err := cl.fetchBatch(bid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": bid,
+		}).Errorf("error: %v", err)
+
+		return err
+	}
+
+	if !found || !b.Archive || b.ArchiveStatus == "succeeded" {
+		log.WithFields(log.Fields{
+			"batch": bid,
+		}).Info("no pending archive for batch, won't proceed")
+
+		return nil
+	}
+
+	b.ArchiveStatus = "processing"
+	err = cl.updateBatch(&b)
+	if err != nil {
+		return err
+	}
+
+	err = cl.storeBatchArchive(&b)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"batch": bid,
+		}).Errorf("error: %v", err)
+
+		// Keep the archive pending if it's going to be retried
+		b.ArchiveStatus = "pending"
+		if int(job.Fails)+1 >= workerMaxAttempts() {
+			b.ArchiveStatus = "failed"
+			b.ArchiveError = err.Error()
+		}
+		cl.updateBatch(&b)
+
+		return err
+	}
+
+	b.ArchiveStatus = "succeeded"
+	b.ArchiveError = ""
+	err = cl.updateBatch(&b)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"batch": bid,
+	}).Info("stored batch archive")
+
+	return nil
+}
+
+// generateBatchResponse counts the jobs of the batch by their status
+func (b *Batch) generateBatchResponse(clt *Client) (batchResponse, error) {
+	brs := batchResponse{
+		Identifier: b.Identifier,
+		CreatedAt:  b.CreatedAt,
+		ExpiresIn:  b.ExpiresIn,
+		Status:     "processing",
+		Total:      b.Size,
+		Counts:     map[string]int{},
+	}
+
+	jids, err := clt.fetchBatchJobs(b.Identifier)
+	if err != nil {
+		return brs, err
+	}
+	brs.Jobs = jids
+
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	for _, jid := range jids {
+		conn.Send("HGET", generateJobKey(jid), "status")
+	}
+	conn.Flush()
+
+	finished := 0
+	for range jids {
+		status, err := redis.String(conn.Receive())
+		if err == redis.ErrNil {
+			status = "expired"
+		} else if err != nil {
+			return brs, err
+		}
+		brs.Counts[status]++
+
+		cj := ConversionJob{Status: status}
+		if cj.isFinished() || status == "expired" {
+			finished++
+		}
+	}
+
+	if finished == b.Size {
+		brs.Status = "finished"
+	}
+
+	if !b.Archive {
+		return brs, nil
+	}
+
+	brs.Archive = &batchArchiveResponse{
+		Status: b.ArchiveStatus,
+		Error:  b.ArchiveError,
+	}
+	if b.ArchiveStatus != "succeeded" {
+		return brs, nil
+	}
+
+	urlTTL := viper.GetInt("server.url_ttl")
+	timeToExpire := time.Duration(urlTTL) * time.Second
+	aj := b.archiveJob()
+	surl, err := clt.storage.Locate(&aj, timeToExpire)
+	if err != nil {
+		return brs, err
+	}
+	brs.Archive.FileURL = surl
+	brs.Archive.FileURLExpiresAt = time.Now().UTC().Add(timeToExpire).Format(time.RFC3339)
+
+	return brs, nil
+}
+
+// prepareBatchRequest decodes and validates a render request of a batch the
+// same way a render request on its own is
+func (clt *Client) prepareBatchRequest(br batchRequest) (renderRequest, error) {
+	rrq := newRenderRequest(br.Type)
+	if rrq == nil {
+		return rrq, fmt.Errorf("invalid render target type '%s'", br.Type)
+	}
+
+	err := validateTarget(br.Type, br.Request)
+	if err != nil {
+		return rrq, err
+	}
+
+	err = json.Unmarshal(br.Request, rrq)
+	if err != nil {
+		return rrq, fmt.Errorf("unable to unmarshal json to %s type", br.Type)
+	}
+
+	if rrq.sourceOptions().Bundle {
+		return rrq, fmt.Errorf("bundles can't be rendered in batches")
+	}
+
+	err = rrq.validate()
+	if err != nil {
+		return rrq, err
+	}
+
+	err = clt.checkSources(rrq)
+	if err != nil {
+		return rrq, err
+	}
+
+	err = clt.checkCallback(rrq.callbackURL())
+	if err != nil {
+		return rrq, err
+	}
+
+	for _, src := range rrq.inputSources() {
+		if src.Template == "" {
+			continue
+		}
+
+		_, found, err := clt.fetchTemplate(src.Template)
+		if err != nil {
+			return rrq, err
+		}
+
+		if !found {
+			return rrq, fmt.Errorf("template '%s' not found", src.Template)
+		}
+	}
+
+	return rrq, nil
+}
+
+func (clt *Client) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	bid := uuid.NewV4().String()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "unable to read request body",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	brq := batchRenderRequest{}
+	err = json.Unmarshal(body, &brq)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "unable to unmarshal json to batch type",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	maxBatchSize := viper.GetInt("server.max_batch_size")
+	if len(brq.Requests) == 0 || len(brq.Requests) > maxBatchSize {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    fmt.Sprintf("batch has %d requests, it has to have between 1 and %d", len(brq.Requests), maxBatchSize),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	client, err := parseClient(r)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	// Every request is checked before any is enqueued so that the batch is
+	// either accepted or rejected as a whole
+	rrqs := make([]renderRequest, len(brq.Requests))
+	denied := false
+	for i, br := range brq.Requests {
+		field := fmt.Sprintf("requests[%d]", i)
+
+		rrq, err := clt.prepareBatchRequest(br)
+		if err == nil {
+			rrqs[i] = rrq
+
+			continue
+		}
+
+		if verr, ok := err.(*validationError); ok {
+			for _, fe := range verr.fields {
+				ers.Errors = append(ers.Errors, fieldError{
+					Field:   fmt.Sprintf("%s.%s", field, fe.Field),
+					Message: fe.Message,
+				})
+			}
+
+			continue
+		}
+
+		if perr, ok := err.(*sourcePolicyError); ok && perr.denied {
+			denied = true
+		}
+		ers.Errors = append(ers.Errors, fieldError{Field: field, Message: err.Error()})
+	}
+
+	if len(ers.Errors) > 0 {
+		ers.Identifier = bid
+		ers.Message = fmt.Sprintf("invalid batch, %d errors in its requests", len(ers.Errors))
+		if denied {
+			requestForbiddenResponse(&w, r, ers)
+		} else {
+			requestBadRequestResponse(&w, r, ers)
+		}
+
+		return
+	}
+
+	b, err := clt.createBatch(bid, len(rrqs), brq.Archive)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "unable to save batch",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	// Jobs are held until all of them are saved, so that failing to save one
+	// doesn't leave the rest of the batch running
+	cjs := []ConversionJob{}
+	for _, rrq := range rrqs {
+		rid := uuid.NewV4().String()
+
+		err = clt.addBatchJob(&b, rid)
+		if err == nil {
+			var cj ConversionJob
+			cj, err = rrq.save(rid, jobOrigin{client: client, batch: bid, held: true}, clt)
+			if err == nil {
+				cjs = append(cjs, cj)
+			}
+		}
+		if err != nil {
+			clt.discardBatch(&b, cjs)
+
+			ers = errorResponse{
+				Identifier: bid,
+				Message:    "unable to save batch jobs",
+			}
+			requestInternalServerErrorResponse(&w, r, ers)
+
+			return
+		}
+	}
+
+	for i := range cjs {
+		err = clt.enqueueConversionJob(cjs[i].Identifier)
+		if err == nil {
+			continue
+		}
+
+		// Some jobs may have been enqueued already, cancel all of them so that
+		// the batch is rejected as a whole. The batch is discarded first so
+		// that the cancelled jobs don't finish it
+		clt.discardBatch(&b, nil)
+		for j := range cjs {
+			clt.cancelConversionJob(&cjs[j])
+		}
+
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "unable to enqueue batch jobs",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+	log.WithFields(log.Fields{
+		"batch": bid,
+	}).Infof("enqueued batch of %d render jobs", len(rrqs))
+
+	brs, err := b.generateBatchResponse(clt)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "failed to generate batch response",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/batches/%s", bid))
+	requestJSONResponse(&w, r, http.StatusCreated, brs)
+}
+
+func (clt *Client) batchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	bid := params["uuid"]
+
+	_, err := uuid.FromString(bid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "invalid batch identifier",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	b, found, err := clt.fetchBatch(bid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "unable to fetch batch",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !found {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "batch not found",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	brs, err := b.generateBatchResponse(clt)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: bid,
+			Message:    "failed to generate batch response",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	requestJSONResponse(&w, r, http.StatusOK, brs)
+}
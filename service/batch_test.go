@@ -0,0 +1,93 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPrepareBatchRequest(t *testing.T) {
+	viper.Set("server.max_html_size", 16)
+	defer viper.Set("server.max_html_size", nil)
+
+	clt := &Client{
+		sourcePolicy: newTestSourcePolicy(t, sourcePolicy{}, nil, nil),
+	}
+
+	tests := []struct {
+		name       string
+		br         batchRequest
+		wantErr    bool
+		wantFields []string
+		wantDenied bool
+	}{
+		{"image", batchRequest{"image", json.RawMessage(`{"source":{"url":"https://93.184.216.34/"},"target":{"format":"png"}}`)}, false, nil, false},
+		{"pdf", batchRequest{"pdf", json.RawMessage(`{"source":{"url":"https://93.184.216.34/"},"target":{"orientation":"Landscape"}}`)}, false, nil, false},
+		{"inline html", batchRequest{"pdf", json.RawMessage(`{"source":{"html":"<p>Hello</p>"}}`)}, false, nil, false},
+		{"too much html", batchRequest{"pdf", json.RawMessage(`{"source":{"html":"<p>Hello, world!</p>"}}`)}, true, nil, false},
+		{"unknown type", batchRequest{"gif", json.RawMessage(`{"source":{"url":"https://93.184.216.34/"}}`)}, true, nil, false},
+		{"not json", batchRequest{"pdf", json.RawMessage(`"source"`)}, true, nil, false},
+		{"no source", batchRequest{"pdf", json.RawMessage(`{}`)}, true, nil, false},
+		{"bundle", batchRequest{"pdf", json.RawMessage(`{"source":{"bundle":true}}`)}, true, nil, false},
+		{"invalid target", batchRequest{"image", json.RawMessage(`{"source":{"url":"https://93.184.216.34/"},"target":{"quality":"high","dpi":300}}`)}, true, []string{"target.dpi", "target.quality"}, false},
+		{"denied source", batchRequest{"image", json.RawMessage(`{"source":{"url":"http://127.0.0.1/"}}`)}, true, nil, true},
+		{"denied callback", batchRequest{"image", json.RawMessage(`{"source":{"url":"https://93.184.216.34/"},"callback_url":"http://169.254.169.254/"}`)}, true, nil, true},
+	}
+
+	for _, tt := range tests {
+		rrq, err := clt.prepareBatchRequest(tt.br)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+		if !tt.wantErr {
+			if rrq == nil {
+				t.Errorf("%s: got no render request", tt.name)
+			}
+
+			continue
+		}
+
+		if tt.wantFields != nil {
+			verr, ok := err.(*validationError)
+			if !ok {
+				t.Errorf("%s: got %T, want a validation error", tt.name, err)
+
+				continue
+			}
+
+			fields := map[string]bool{}
+			for _, fe := range verr.fields {
+				fields[fe.Field] = true
+			}
+			for _, field := range tt.wantFields {
+				if !fields[field] {
+					t.Errorf("%s: got errors %v, want one for %s", tt.name, verr.fields, field)
+				}
+			}
+		}
+
+		perr, ok := err.(*sourcePolicyError)
+		denied := ok && perr.denied
+		if denied != tt.wantDenied {
+			t.Errorf("%s: got denied %v, want %v (%v)", tt.name, denied, tt.wantDenied, err)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MinMaxBundleSize is the minimum that the maximum size of uploaded
+	// bundles can be set to, in bytes
+	MinMaxBundleSize = 1024
+
+	// bundleIndexFile is the file in a bundle that is rendered
+	bundleIndexFile = "index.html"
+
+	// bundleDir is the directory in the working directory of the job that
+	// bundles are extracted to
+	bundleDir = "bundle"
+
+	// bundleMaxFiles is the maximum number of files a bundle can have
+	bundleMaxFiles = 1000
+
+	// bundleMaxExtractedSize is the maximum size that a bundle can have once
+	// extracted, in bytes
+	bundleMaxExtractedSize = 256 * 1024 * 1024
+
+	// bundleRequestField is the multipart form field carrying the render
+	// request, bundleArchiveField carries the bundle as a ZIP archive
+	bundleRequestField = "request"
+	bundleArchiveField = "bundle"
+)
+
+func generateBundleKey(jid string) string {
+	key := fmt.Sprintf("%s:bundle:%s", viper.GetString("redis.namespace"), jid)
+
+	return key
+}
+
+// cleanBundlePath returns the path of a file in a bundle relative to the root
+// of the bundle, or an error if the path would point outside of it
+func cleanBundlePath(name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	clean := path.Clean("/" + name)
+	if clean == "/" || path.IsAbs(name) || strings.Contains(name, "../") || strings.HasPrefix(name, "..") {
+		return "", fmt.Errorf("invalid path '%s' in bundle", name)
+	}
+
+	return strings.TrimPrefix(clean, "/"), nil
+}
+
+func validateBundle(data []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("bundle is not a valid ZIP archive")
+	}
+
+	if len(zr.File) > bundleMaxFiles {
+		return fmt.Errorf("bundle has %d files, yet the maximum is %d", len(zr.File), bundleMaxFiles)
+	}
+
+	var size uint64
+	hasIndex := false
+	for _, f := range zr.File {
+		name, err := cleanBundlePath(f.Name)
+		if err != nil {
+			return err
+		}
+
+		if name == bundleIndexFile {
+			hasIndex = true
+		}
+		size += f.UncompressedSize64
+	}
+
+	if !hasIndex {
+		return fmt.Errorf("bundle has no %s at its root", bundleIndexFile)
+	}
+
+	if size > bundleMaxExtractedSize {
+		return fmt.Errorf("bundle is %d bytes once extracted, yet the maximum is %d", size, bundleMaxExtractedSize)
+	}
+
+	return nil
+}
+
+func extractBundle(data []byte, dir string) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, f := range zr.File {
+		name, err := cleanBundlePath(f.Name)
+		if err != nil {
+			return err
+		}
+
+		fp := filepath.Join(dir, filepath.FromSlash(name))
+		if f.FileInfo().IsDir() {
+			err = os.MkdirAll(fp, 0700)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(fp), 0700)
+		if err != nil {
+			return err
+		}
+
+		src, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		dst, err := os.OpenFile(fp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			src.Close()
+
+			return err
+		}
+
+		// Don't trust the sizes in the archive, stop copying once the limit
+		// is exceeded
+		n, err := io.CopyN(dst, src, bundleMaxExtractedSize-size+1)
+		src.Close()
+		dst.Close()
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		size += n
+		if size > bundleMaxExtractedSize {
+			return fmt.Errorf("bundle exceeds %d bytes once extracted", bundleMaxExtractedSize)
+		}
+	}
+
+	return nil
+}
+
+// readMultipartBundle reads the render request and the bundle from a
+// multipart form. The bundle is either uploaded as a ZIP archive or as
+// separate files, each named by its path in the bundle, which are then
+// archived
+func readMultipartBundle(r *http.Request) (string, []byte, error) {
+	var (
+		request string
+		archive []byte
+	)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return request, archive, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := 0
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return request, archive, err
+		}
+
+		field := part.FormName()
+		switch {
+		case field == bundleRequestField:
+			data, err := ioutil.ReadAll(part)
+			if err != nil {
+				return request, archive, err
+			}
+			request = string(data)
+		case field == bundleArchiveField:
+			archive, err = ioutil.ReadAll(part)
+			if err != nil {
+				return request, archive, err
+			}
+		case field != "":
+			name, err := cleanBundlePath(field)
+			if err != nil {
+				return request, archive, err
+			}
+
+			fw, err := zw.Create(name)
+			if err != nil {
+				return request, archive, err
+			}
+
+			_, err = io.Copy(fw, part)
+			if err != nil {
+				return request, archive, err
+			}
+			files++
+		}
+		part.Close()
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return request, archive, err
+	}
+
+	if archive != nil && files > 0 {
+		return request, archive, fmt.Errorf("bundle can either be a ZIP archive or separate files, not both")
+	}
+
+	if archive == nil {
+		archive = buf.Bytes()
+	}
+
+	return request, archive, nil
+}
+
+func (clt *Client) saveBundle(jid string, data []byte) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	rt := viper.GetInt("server.request_ttl")
+	_, err := conn.Do("SET", generateBundleKey(jid), data, "EX", rt)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Error("error saving bundle")
+
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": jid,
+	}).Debug("saved bundle")
+
+	return nil
+}
+
+func (clt *Client) fetchBundle(jid string) ([]byte, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", generateBundleKey(jid)))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Error("unable to fetch bundle from redis")
+
+		return data, err
+	}
+
+	return data, nil
+}
+
+func (clt *Client) deleteBundle(jid string) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", generateBundleKey(jid))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Error("error deleting bundle")
+
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": jid,
+	}).Debug("deleted bundle")
+
+	return nil
+}
+
+// releaseBundle deletes the bundle of the conversion job, if it has one. It's
+// kept until the job succeeds, fails or is cancelled so that retries can use
+// it, otherwise it expires along with the request
+func (clt *Client) releaseBundle(cj *ConversionJob) {
+	rR, err := cj.renderRequest()
+	if err != nil || !rR.sourceOptions().Bundle {
+		return
+	}
+
+	clt.deleteBundle(cj.Identifier)
+}
+
+func (clt *Client) renderBundleHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		ers     errorResponse
+		request string
+		archive []byte
+	)
+
+	params := mux.Vars(r)
+	target := params["target"]
+	rid := uuid.NewV4().String()
+
+	rrq := newRenderRequest(target)
+	if rrq == nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    fmt.Sprintf("invalid %s render request", target),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	wait, err := parseRenderWait(r)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	maxBundleSize := viper.GetInt64("server.max_bundle_size")
+	r.Body = http.MaxBytesReader(w, r.Body, maxBundleSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/zip":
+		request = r.URL.Query().Get(bundleRequestField)
+		archive, err = ioutil.ReadAll(r.Body)
+	default:
+		request, archive, err = readMultipartBundle(r)
+	}
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    fmt.Sprintf("unable to read bundle of at most %d bytes: %v", maxBundleSize, err),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	var data []byte
+	if request != "" {
+		data = []byte(request)
+	}
+
+	clt.submitRenderRequest(w, r, rid, target, rrq, data, archive, wait)
+}
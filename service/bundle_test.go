@@ -0,0 +1,112 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func TestCleanBundlePath(t *testing.T) {
+	tests := []struct {
+		name  string
+		clean string
+		err   bool
+	}{
+		{name: "index.html", clean: "index.html"},
+		{name: "css/invoice.css", clean: "css/invoice.css"},
+		{name: "./css/invoice.css", clean: "css/invoice.css"},
+		{name: "css//fonts/./a.woff", clean: "css/fonts/a.woff"},
+		{name: `css\invoice.css`, clean: "css/invoice.css"},
+		{name: "..invoice.css", err: true},
+		{name: "../index.html", err: true},
+		{name: "css/../../index.html", err: true},
+		{name: "css/../index.html", err: true},
+		{name: `..\index.html`, err: true},
+		{name: `css\..\..\etc\passwd`, err: true},
+		{name: "..", err: true},
+		{name: "/etc/passwd", err: true},
+		{name: `\etc\passwd`, err: true},
+		{name: "", err: true},
+		{name: "/", err: true},
+		{name: ".", err: true},
+	}
+
+	for _, tt := range tests {
+		clean, err := cleanBundlePath(tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("'%s': expected an error, got '%s'", tt.name, clean)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", tt.name, err)
+
+			continue
+		}
+
+		if clean != tt.clean {
+			t.Errorf("'%s': expected '%s', got '%s'", tt.name, tt.clean, clean)
+		}
+	}
+}
+
+func TestValidateBundle(t *testing.T) {
+	archive := func(names ...string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, name := range names {
+			fw, err := zw.Create(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("<p>hello</p>"))
+		}
+		zw.Close()
+
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		valid bool
+	}{
+		{name: "index only", data: archive("index.html"), valid: true},
+		{name: "index and assets", data: archive("index.html", "css/invoice.css", "img/logo.png"), valid: true},
+		{name: "no index", data: archive("css/invoice.css"), valid: false},
+		{name: "index in a directory", data: archive("site/index.html"), valid: false},
+		{name: "zip slip", data: archive("index.html", "../../etc/cron.d/evil"), valid: false},
+		{name: "absolute path", data: archive("index.html", "/etc/passwd"), valid: false},
+		{name: "not a zip", data: []byte("<p>hello</p>"), valid: false},
+		{name: "empty", data: []byte{}, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := validateBundle(tt.data)
+		if tt.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
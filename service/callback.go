@@ -0,0 +1,374 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gocraft/work"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	callbackQueue = "callback"
+
+	// MinCallbackMaxAttempts is the minimum number of times delivery of a
+	// callback can be set to be attempted
+	MinCallbackMaxAttempts = 1
+
+	// MinCallbackTimeout is the minimum time a callback can be set to wait for
+	// a response, in seconds
+	MinCallbackTimeout = 1
+
+	// callbackConcurrency is the number of callbacks the server delivers at a
+	// time
+	callbackConcurrency = 5
+
+	// callbackBackoff is how long to wait before the first retry of a failed
+	// callback, it doubles with every attempt after
+	callbackBackoff = 30 * time.Second
+
+	callbackTimestampHeader = "X-Sanaa-Timestamp"
+	callbackSignatureHeader = "X-Sanaa-Signature"
+)
+
+// callbackAttempt is a record of an attempt to deliver a callback
+type callbackAttempt struct {
+	Attempt     int    `json:"attempt"`
+	AttemptedAt string `json:"attempted_at"`
+	StatusCode  int    `json:"status_code,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// callbackResponse is the state of delivery of the callback of a render
+// request, it's 'pending' until it's either 'delivered' or 'failed'
+type callbackResponse struct {
+	URL      string            `json:"url"`
+	Status   string            `json:"status"`
+	Attempts []callbackAttempt `json:"attempts"`
+}
+
+// validateCallbackURL validates the URL that is notified once a render request
+// is done, it's optional
+func validateCallbackURL(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("invalid callback_url, %v", err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return fmt.Errorf("invalid callback_url, the scheme has to be http or https")
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid callback_url, it has no host")
+	}
+
+	return nil
+}
+
+// checkCallback checks the callback URL against the source policy, callbacks
+// are made from inside the network just like sources are fetched
+func (clt *Client) checkCallback(callbackURL string) error {
+	if callbackURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("invalid callback url, %v", err),
+		}
+	}
+
+	return clt.sourcePolicy.check(u)
+}
+
+// signCallback returns the signature of a callback, a hex encoded HMAC-SHA256
+// of the timestamp and body joined by a '.'
+func signCallback(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (cj *ConversionJob) callbackAttempts() []callbackAttempt {
+	var attempts []callbackAttempt
+
+	if len(cj.CallbackAttempts) == 0 {
+		return attempts
+	}
+
+	err := json.Unmarshal(cj.CallbackAttempts, &attempts)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("unable to unmarshal callback attempts: %v", err)
+	}
+
+	return attempts
+}
+
+func (cj *ConversionJob) recordCallbackAttempt(attempt callbackAttempt) error {
+	attempts := append(cj.callbackAttempts(), attempt)
+
+	data, err := json.Marshal(attempts)
+	if err != nil {
+		return err
+	}
+	cj.CallbackAttempts = data
+
+	return nil
+}
+
+func (cj *ConversionJob) generateCallbackResponse() *callbackResponse {
+	if cj.CallbackURL == "" {
+		return nil
+	}
+
+	crs := &callbackResponse{
+		URL:      cj.CallbackURL,
+		Status:   cj.CallbackStatus,
+		Attempts: cj.callbackAttempts(),
+	}
+	if crs.Attempts == nil {
+		crs.Attempts = []callbackAttempt{}
+	}
+
+	return crs
+}
+
+// callbackBody returns the body of the callback of the conversion job i.e. its
+// render response
+func (cj *ConversionJob) callbackBody(clt *Client) ([]byte, error) {
+	rrs, err := cj.generateRenderResponse(clt)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(rrs)
+}
+
+// enqueueCallback schedules delivery of the callback of a finished conversion
+// job, retries are scheduled with a delay that doubles with every attempt
+func (clt *Client) enqueueCallback(cj *ConversionJob, attempt int) error {
+	if cj.CallbackURL == "" {
+		return nil
+	}
+
+	args := work.Q{"uuid": cj.Identifier, "attempt": attempt}
+
+	var err error
+	if attempt <= 1 {
+		_, err = clt.enqueuer.Enqueue(callbackQueue, args)
+	} else {
+		delay := callbackBackoff * time.Duration(1<<uint(attempt-2))
+		_, err = clt.enqueuer.EnqueueIn(callbackQueue, int64(delay/time.Second), args)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("error enqueueing callback: %v", err)
+
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debugf("enqueued callback attempt %d", attempt)
+
+	return nil
+}
+
+// postCallback posts the body to the callback URL, signed if a secret is set,
+// and returns the status code of the response. It only connects to addresses
+// that the source policy allows
+func (cl *Client) postCallback(callbackURL string, body []byte) (int, error) {
+	timeout := time.Duration(viper.GetInt("server.callback_timeout")) * time.Second
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       cl.sourcePolicy.dialContext,
+			DisableKeepAlives: true,
+		},
+		// Redirects would get around the checks of the callback URL
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(callbackTimestampHeader, timestamp)
+	if secret := viper.GetString("server.callback_secret"); secret != "" {
+		req.Header.Set(callbackSignatureHeader, signCallback([]byte(secret), timestamp, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("callback responded with '%s'", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+type callbackContext struct{}
+
+// deliver posts the render response of a finished conversion job to its
+// callback URL. Failed attempts are retried by enqueueing the next attempt
+// rather than failing the job, so that the backoff and the number of attempts
+// are up to us
+func (ctx *callbackContext) deliver(job *work.Job) error {
+	cl := NewClient()
+
+	jid := job.ArgString("uuid")
+	attempt := int(job.ArgInt64("attempt"))
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	cj, found, err := cl.fetchConversionJob(jid)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Errorf("error: %v", err)
+
+		return err
+	}
+
+	// Nothing to notify about once the job expires
+	if !found || cj.CallbackURL == "" || cj.CallbackStatus != "pending" {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Info("no pending callback for conversion job, won't proceed")
+
+		return nil
+	}
+
+	ca := callbackAttempt{
+		Attempt:     attempt,
+		AttemptedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	retry := true
+
+	// Failing to generate the body e.g. to locate the rendered file, is a
+	// failed attempt like any other so that the callback doesn't stay pending.
+	// The callback is checked again in case what its host resolves to has
+	// changed since the request was made, retrying won't change the outcome
+	body, err := cj.callbackBody(&cl)
+	if err != nil {
+		err = fmt.Errorf("unable to generate render response, %v", err)
+	} else if err = cl.checkCallback(cj.CallbackURL); err != nil {
+		retry = false
+	} else {
+		ca.StatusCode, err = cl.postCallback(cj.CallbackURL, body)
+	}
+
+	if err != nil {
+		ca.Error = err.Error()
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Warnf("callback attempt %d failed: %v", attempt, err)
+	} else {
+		cj.CallbackStatus = "delivered"
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Infof("delivered callback on attempt %d", attempt)
+	}
+
+	maxAttempts := viper.GetInt("server.callback_max_attempts")
+	if err != nil && (!retry || attempt >= maxAttempts) {
+		cj.CallbackStatus = "failed"
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Errorf("giving up on callback after %d attempts", attempt)
+	}
+
+	err = cj.recordCallbackAttempt(ca)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Errorf("error: %v", err)
+
+		return err
+	}
+
+	err = cl.updateConversionJob(&cj)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Errorf("error: %v", err)
+
+		return err
+	}
+
+	if cj.CallbackStatus == "pending" {
+		return cl.enqueueCallback(&cj, attempt+1)
+	}
+
+	return nil
+}
+
+// startCallbackDispatcher starts delivering callbacks of finished conversion
+// jobs in the background
+func (clt *Client) startCallbackDispatcher() *work.WorkerPool {
+	namespace := viper.GetString("redis.namespace")
+	pool := work.NewWorkerPool(callbackContext{}, callbackConcurrency, namespace, clt.redisPool)
+
+	// Retries are enqueued by the job itself, see deliver
+	jobOptions := work.JobOptions{MaxFails: 1}
+
+	log.Infof("registering '%s' queue", callbackQueue)
+	pool.JobWithOptions(callbackQueue, jobOptions, (*callbackContext).deliver)
+	pool.Start()
+
+	return pool
+}
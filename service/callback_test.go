@@ -0,0 +1,58 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSignCallback(t *testing.T) {
+	expected := func(secret string, message string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(message))
+
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"body", "secret", "1517897949", `{"uuid":"1"}`, expected("secret", `1517897949.{"uuid":"1"}`)},
+		{"empty body", "secret", "1517897949", "", expected("secret", "1517897949.")},
+		{"other secret", "other", "1517897949", `{"uuid":"1"}`, expected("other", `1517897949.{"uuid":"1"}`)},
+		{"known value", "key", "0", "", "sha256=85841b4efc3cd7776c3c8f9b7cca9e281c550e5d19889d78e9e669c6337f000d"},
+	}
+
+	for _, tt := range tests {
+		got := signCallback([]byte(tt.secret), tt.timestamp, []byte(tt.body))
+		if got != tt.want {
+			t.Errorf("%s: got '%s', want '%s'", tt.name, got, tt.want)
+		}
+	}
+
+	// The timestamp is signed along with the body, so that it can't be
+	// swapped for another e.g. to replay a callback
+	if signCallback([]byte("secret"), "1", []byte("body")) == signCallback([]byte("secret"), "2", []byte("body")) {
+		t.Errorf("signature doesn't depend on the timestamp")
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// generateCancelKey returns the key that is set when a conversion job is
+// cancelled. It's what workers go by when they pick up a job, since they may
+// have subscribed to its transitions after it was cancelled
+func generateCancelKey(jid string) string {
+	key := fmt.Sprintf("%s:cancel:%s", viper.GetString("redis.namespace"), jid)
+
+	return key
+}
+
+func (clt *Client) isCancelled(jid string) (bool, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", generateCancelKey(jid)))
+}
+
+// cancelConversionJob marks the conversion job as cancelled and signals any
+// worker processing it to stop
+func (clt *Client) cancelConversionJob(cj *ConversionJob) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", generateCancelKey(cj.Identifier), 1, "EX", cj.ExpiresIn)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error("error setting conversion job cancellation")
+
+		return err
+	}
+
+	// Workers watch for the transition to stop jobs they're processing
+	cj.markAsCancelled()
+	err = clt.updateConversionJob(cj)
+	if err != nil {
+		return err
+	}
+	clt.releaseBundle(cj)
+
+	return nil
+}
+
+// watchCancellation returns a context that is done once the conversion job is
+// cancelled, until the returned function is called
+func (clt *Client) watchCancellation(jid string) (context.Context, func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events, stop, err := subscribeJobEvents(jid)
+	if err != nil {
+		return ctx, cancel, err
+	}
+
+	// The job may have been cancelled before the subscription
+	cancelled, err := clt.isCancelled(jid)
+	if err != nil || cancelled {
+		stop()
+		cancel()
+
+		return ctx, cancel, err
+	}
+
+	go func() {
+		for event := range events {
+			if event.Status == "cancelled" {
+				log.WithFields(log.Fields{
+					"uuid": jid,
+				}).Info("conversion job cancelled, stopping")
+				cancel()
+
+				return
+			}
+		}
+	}()
+
+	done := func() {
+		stop()
+		cancel()
+	}
+
+	return ctx, done, nil
+}
+
+func (clt *Client) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	jid := params["uuid"]
+
+	_, err := uuid.FromString(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "invalid job identifier",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	cj, found, err := clt.fetchConversionJob(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to fetch conversion job",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !found {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "request not found on conversion queue",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	if cj.isFinished() {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    fmt.Sprintf("conversion job has already %s", cj.Status),
+		}
+		requestConflictResponse(&w, r, ers)
+
+		return
+	}
+
+	err = clt.cancelConversionJob(&cj)
+	switch {
+	case err == errJobFinished:
+		// The job finished after it was fetched, possibly cancelled by another
+		// request which took care of the callback
+		cj, found, err = clt.fetchConversionJob(jid)
+		if err != nil || !found {
+			ers = errorResponse{
+				Identifier: jid,
+				Message:    "unable to fetch conversion job",
+			}
+			requestInternalServerErrorResponse(&w, r, ers)
+
+			return
+		}
+
+		if cj.Status != "cancelled" {
+			ers = errorResponse{
+				Identifier: jid,
+				Message:    fmt.Sprintf("conversion job has already %s", cj.Status),
+			}
+			requestConflictResponse(&w, r, ers)
+
+			return
+		}
+	case err != nil:
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to cancel conversion job",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	default:
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Info("cancelled conversion job")
+
+		// Workers leave sending the callback to whoever saved the cancellation
+		clt.enqueueCallback(&cj, 1)
+	}
+
+	rrs, err := cj.generateRenderResponse(clt)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "failed to generate render response",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	requestOKResponse(&w, r, rrs)
+}
@@ -0,0 +1,155 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gocraft/work"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cleanupQueue = "cleanup"
+
+	// cleanupBatchSize is the number of expired files to fetch from redis at a
+	// time when cleaning up
+	cleanupBatchSize = 100
+)
+
+// storedFile is a reference to a stored file that outlives its conversion job
+// so that the file can be deleted once the job expires
+type storedFile struct {
+	Identifier string `json:"uuid"`
+	Location   string `json:"location"`
+}
+
+func generateStoredFilesKey() string {
+	key := fmt.Sprintf("%s:stored-files", viper.GetString("redis.namespace"))
+
+	return key
+}
+
+func (clt *Client) trackStoredFile(cj *ConversionJob) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	// The file expires along with the job, which is set to expire a TTL after
+	// it was created
+	createdAt, err := time.Parse(time.RFC3339, cj.CreatedAt)
+	if err != nil {
+		return err
+	}
+	expiresAt := createdAt.Add(time.Duration(cj.ExpiresIn) * time.Second)
+
+	member, err := json.Marshal(storedFile{
+		Identifier: cj.Identifier,
+		Location:   cj.StorageLocation,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("ZADD", generateStoredFilesKey(), expiresAt.Unix(), member)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error("error tracking stored file for cleanup")
+
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debugf("tracking stored file for cleanup at %s", expiresAt.Format(time.RFC3339))
+
+	return nil
+}
+
+func (ctx *workerContext) cleanup(job *work.Job) error {
+	cl := NewClient()
+	conn := cl.redisPool.Get()
+	defer conn.Close()
+
+	key := generateStoredFilesKey()
+	now := time.Now().Unix()
+	offset := 0
+
+	log.Debug("start cleanup of expired stored files")
+
+	for {
+		members, err := redis.Strings(conn.Do("ZRANGEBYSCORE", key, "-inf", now, "LIMIT", offset, cleanupBatchSize))
+		if err != nil {
+			log.Errorf("error fetching expired stored files: %v", err)
+
+			return err
+		}
+
+		if len(members) == 0 {
+			break
+		}
+
+		for _, member := range members {
+			sf := storedFile{}
+			err = json.Unmarshal([]byte(member), &sf)
+			if err != nil {
+				log.Errorf("error unmarshalling stored file reference, dropping it: %v", err)
+				conn.Do("ZREM", key, member)
+
+				continue
+			}
+
+			cj := ConversionJob{
+				Identifier:      sf.Identifier,
+				StorageLocation: sf.Location,
+			}
+
+			// Leave the reference in place if we fail to delete the file so that
+			// it's retried during the next cleanup
+			err = cl.storage.Delete(&cj)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"uuid": sf.Identifier,
+				}).Errorf("error deleting expired stored file: %v", err)
+				offset++
+
+				continue
+			}
+
+			_, err = conn.Do("ZREM", key, member)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"uuid": sf.Identifier,
+				}).Errorf("error: %v", err)
+
+				return err
+			}
+
+			log.WithFields(log.Fields{
+				"uuid": sf.Identifier,
+			}).Info("cleaned up expired stored file")
+		}
+	}
+
+	log.Debug("completed cleanup of expired stored files")
+
+	return nil
+}
@@ -18,17 +18,28 @@ package service
 import (
 	"fmt"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gocraft/work"
 	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Client is the application client
 type Client struct {
-	awsSession *session.Session
-	enqueuer   *work.Enqueuer
-	redisPool  *redis.Pool
+	enqueuer     *work.Enqueuer
+	redisPool    *redis.Pool
+	storage      Storage
+	sourcePolicy *sourcePolicy
+}
+
+// dialRedis opens a connection to redis, outside of the pool for connections
+// that are held for long e.g. subscriptions
+func dialRedis() (redis.Conn, error) {
+	host := viper.GetString("redis.host")
+	port := viper.GetInt("redis.port")
+
+	return redis.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
 }
 
 // NewClient creates an initialized application client
@@ -37,21 +48,22 @@ func NewClient() Client {
 		MaxActive: 5,
 		MaxIdle:   5,
 		Wait:      true,
-		Dial: func() (redis.Conn, error) {
-			host := viper.GetString("redis.host")
-			port := viper.GetInt("redis.port")
-
-			return redis.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-		},
+		Dial:      dialRedis,
 	}
 	enqueuer := work.NewEnqueuer(viper.GetString("redis.namespace"), redisPool)
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+	storage, err := newStorage(viper.GetString("storage.backend"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sourcePolicy, err := newSourcePolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	return Client{
-		awsSession: sess,
-		enqueuer:   enqueuer,
-		redisPool:  redisPool,
+		enqueuer:     enqueuer,
+		redisPool:    redisPool,
+		storage:      storage,
+		sourcePolicy: sourcePolicy,
 	}
 }
@@ -0,0 +1,87 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"github.com/itskingori/go-wkhtml/wkhtmltox"
+)
+
+const (
+	imageConverter = "wkhtmltoimage"
+	pdfConverter   = "wkhtmltopdf"
+)
+
+// converterArgs returns the arguments passed in preceded by those every
+// conversion runs with. Page options that come before the first object are the
+// defaults of every object, so local file access is disabled for all pages and
+// only the directories that sources render from are allowed by their '--allow'
+// flags. Everything else is loaded through the source proxy so that the source
+// policy applies to it
+func converterArgs(args []string) []string {
+	base := []string{"--disable-local-file-access"}
+	if sourceProxyURL != "" {
+		base = append(base, "--proxy", sourceProxyURL)
+	}
+
+	return append(base, args...)
+}
+
+// runConverter runs the named wkhtmltox converter with the arguments passed in
+// and returns its output
+func runConverter(ctx context.Context, name string, args []string) ([]byte, error) {
+	path, _, err := wkhtmltox.LookupConverter(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(path, converterArgs(args)...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	// Run the converter in its own process group so that it can be killed
+	// along with any processes it starts
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed, %s", name, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+		err = ctx.Err()
+	}
+	if err != nil {
+		return output.Bytes(), fmt.Errorf("%s failed, %s", name, err)
+	}
+
+	return output.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConverterArgsDisableLocalFileAccess(t *testing.T) {
+	workDir, err := ioutil.TempDir("", "sanaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+
+	url := source{URL: "https://example.com/"}
+	html := source{HTML: "<p>Hello</p>"}
+
+	tests := []struct {
+		name    string
+		rr      interface{}
+		allowed []string
+	}{
+		{"image url", &imageRenderRequest{Source: url}, nil},
+		{"image html", &imageRenderRequest{Source: html}, []string{workDir}},
+		{"pdf url", &pdfRenderRequest{Source: url}, nil},
+		{"pdf html", &pdfRenderRequest{Source: html}, []string{workDir}},
+		{"pdf url sources", &pdfRenderRequest{Sources: []pageSource{{source: url}, {source: url}}}, nil},
+		{"pdf url header", &pdfRenderRequest{Source: url, Header: &headerFooter{source: url}}, nil},
+		{"pdf html cover", &pdfRenderRequest{Source: url, Cover: &pageSource{source: html}}, []string{filepath.Join(workDir, pdfPartsDir)}},
+	}
+
+	for _, tt := range tests {
+		var (
+			args []string
+			err  error
+		)
+		outputFile := filepath.Join(workDir, "file.out")
+		switch rr := tt.rr.(type) {
+		case *imageRenderRequest:
+			args, err = rr.arguments(nil, &ConversionJob{}, workDir, outputFile)
+		case *pdfRenderRequest:
+			args, err = rr.arguments(nil, &ConversionJob{}, workDir, outputFile)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+		args = converterArgs(args)
+
+		// The flag has to come before the first object so that it applies to
+		// all of them
+		if args[0] != "--disable-local-file-access" {
+			t.Errorf("%s: local file access isn't disabled first in %v", tt.name, args)
+		}
+
+		var allowed []string
+		for i, arg := range args {
+			if arg == "--enable-local-file-access" {
+				t.Errorf("%s: local file access is enabled in %v", tt.name, args)
+			}
+			if arg == "--allow" && i+1 < len(args) {
+				allowed = append(allowed, args[i+1])
+			}
+		}
+		if len(allowed) != len(tt.allowed) {
+			t.Errorf("%s: got allowed directories %v, want %v", tt.name, allowed, tt.allowed)
+
+			continue
+		}
+		for i := range allowed {
+			if allowed[i] != tt.allowed[i] {
+				t.Errorf("%s: got allowed directories %v, want %v", tt.name, allowed, tt.allowed)
+			}
+		}
+	}
+}
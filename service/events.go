@@ -0,0 +1,417 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventsHeartbeatInterval is how often a comment is sent on event streams to
+// keep idle connections from being closed by proxies
+const eventsHeartbeatInterval = 15 * time.Second
+
+// jobEventsBuffer is how many events of a conversion job can be waiting to be
+// received by a subscriber before they're dropped
+const jobEventsBuffer = 16
+
+// jobEvent is published whenever a conversion job changes
+type jobEvent struct {
+	Identifier string `json:"uuid"`
+	Status     string `json:"status"`
+}
+
+func generateJobEventsChannel(jid string) string {
+	key := fmt.Sprintf("%s:job-events:%s", viper.GetString("redis.namespace"), jid)
+
+	return key
+}
+
+// isFinished returns whether the conversion job won't change any more
+func (cj *ConversionJob) isFinished() bool {
+	return cj.Status == "succeeded" || cj.Status == "failed" || cj.Status == "cancelled"
+}
+
+func (clt *Client) publishJobEvent(cj *ConversionJob) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	event, err := json.Marshal(jobEvent{
+		Identifier: cj.Identifier,
+		Status:     cj.Status,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Do("PUBLISH", generateJobEventsChannel(cj.Identifier), event)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error("error publishing conversion job event")
+
+		return err
+	}
+
+	return nil
+}
+
+// jobEventHub shares one subscription to the events of all conversion jobs
+// between everything in the process that waits on them, rather than each
+// holding a connection to redis. Events are fanned out to the subscribers of
+// the job they're about
+type jobEventHub struct {
+	mu          sync.Mutex
+	psc         *redis.PubSubConn
+	subscribers map[string]map[chan jobEvent]struct{}
+}
+
+var jobEvents = &jobEventHub{}
+
+// subscribeJobEvents subscribes to events of the conversion job, each event
+// is sent to the returned channel which is closed once the subscription ends.
+// The subscription ends when the returned function is called
+func subscribeJobEvents(jid string) (<-chan jobEvent, func(), error) {
+	return jobEvents.subscribe(jid)
+}
+
+func (h *jobEventHub) subscribe(jid string) (<-chan jobEvent, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.psc == nil {
+		err := h.connect()
+		if err != nil {
+			return nil, func() {}, err
+		}
+	}
+
+	// Events published from here on are sent to the subscriber since the hub's
+	// subscription is confirmed by now
+	events := make(chan jobEvent, jobEventsBuffer)
+	if h.subscribers[jid] == nil {
+		h.subscribers[jid] = map[chan jobEvent]struct{}{}
+	}
+	h.subscribers[jid][events] = struct{}{}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			h.unsubscribe(jid, events)
+		})
+	}
+
+	return events, cancel, nil
+}
+
+// connect subscribes to the events of all conversion jobs on a connection of
+// its own and starts receiving them, the hub has to be locked
+func (h *jobEventHub) connect() error {
+	conn, err := dialRedis()
+	if err != nil {
+		return err
+	}
+
+	psc := &redis.PubSubConn{Conn: conn}
+	err = psc.PSubscribe(generateJobEventsChannel("*"))
+	if err != nil {
+		psc.Close()
+
+		return err
+	}
+
+	// Wait for the subscription to be confirmed so that events published from
+	// here on aren't missed
+	switch v := psc.Receive().(type) {
+	case redis.Subscription:
+	case error:
+		psc.Close()
+
+		return v
+	}
+
+	h.psc = psc
+	h.subscribers = map[string]map[chan jobEvent]struct{}{}
+	go h.receive(psc)
+
+	return nil
+}
+
+func (h *jobEventHub) receive(psc *redis.PubSubConn) {
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.PMessage:
+			event := jobEvent{}
+			err := json.Unmarshal(v.Data, &event)
+			if err != nil {
+				continue
+			}
+
+			h.dispatch(event)
+		case error:
+			log.Warnf("subscription to conversion job events ended: %v", v)
+			h.reset(psc)
+
+			return
+		}
+	}
+}
+
+func (h *jobEventHub) dispatch(event jobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for events := range h.subscribers[event.Identifier] {
+		// Subscribers fetch the job on each event, so one that is behind only
+		// misses events that it would catch up on anyway
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// reset closes the connection and ends all the subscriptions, the next
+// subscription connects again
+func (h *jobEventHub) reset(psc *redis.PubSubConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	psc.Close()
+	for _, subs := range h.subscribers {
+		for events := range subs {
+			close(events)
+		}
+	}
+	h.subscribers = nil
+	h.psc = nil
+}
+
+func (h *jobEventHub) unsubscribe(jid string, events chan jobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// The subscription may have already ended along with the connection
+	subs := h.subscribers[jid]
+	if _, ok := subs[events]; !ok {
+		return
+	}
+
+	delete(subs, events)
+	if len(subs) == 0 {
+		delete(h.subscribers, jid)
+	}
+	close(events)
+}
+
+// waitForConversionJob waits for the conversion job to finish, for up to
+// timeout or until done is closed. It returns the latest state of the job and
+// whether it finished
+func (clt *Client) waitForConversionJob(jid string, timeout time.Duration, done <-chan struct{}) (ConversionJob, bool, error) {
+	return clt.waitForConversionJobChange(jid, "", timeout, done)
+}
+
+// waitForConversionJobChange waits for the status of the conversion job to
+// change from status, or for it to finish if status is empty, for up to
+// timeout or until done is closed. It returns the latest state of the job and
+// whether it changed
+func (clt *Client) waitForConversionJobChange(jid string, status string, timeout time.Duration, done <-chan struct{}) (ConversionJob, bool, error) {
+	changed := func(cj *ConversionJob) bool {
+		if status == "" {
+			return cj.isFinished()
+		}
+
+		return cj.Status != status || cj.isFinished()
+	}
+
+	events, cancel, err := subscribeJobEvents(jid)
+	if err != nil {
+		return ConversionJob{}, false, err
+	}
+	defer cancel()
+
+	// The job may have changed before the subscription
+	cj, found, err := clt.fetchConversionJob(jid)
+	if err != nil || !found || changed(&cj) {
+		return cj, found && changed(&cj), err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return cj, false, fmt.Errorf("subscription to conversion job events ended")
+			}
+
+			cj, found, err = clt.fetchConversionJob(jid)
+			if err != nil || !found || changed(&cj) {
+				return cj, found && changed(&cj), err
+			}
+		case <-timer.C:
+			return cj, false, nil
+		case <-done:
+			return cj, false, nil
+		}
+	}
+}
+
+// writeRenderEvent writes the render response of the conversion job as an
+// event on the stream
+func writeRenderEvent(w http.ResponseWriter, clt *Client, cj *ConversionJob) error {
+	rrs, err := cj.generateRenderResponse(clt)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rrs)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+
+	return err
+}
+
+func (clt *Client) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	jid := params["uuid"]
+
+	_, err := uuid.FromString(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "invalid job identifier",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "streaming is not supported",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	// Subscribe before fetching the job so that no transition is missed
+	events, cancel, err := subscribeJobEvents(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to subscribe to conversion job events",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+	defer cancel()
+
+	cj, found, err := clt.fetchConversionJob(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to fetch conversion job",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !found {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "request not found on conversion queue",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	log.WithFields(log.Fields{
+		"uuid": jid,
+	}).Info("streaming conversion job events")
+
+	// Start with the current state of the job, then push each transition
+	// until the job finishes
+	status := ""
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		if cj.Status != status {
+			err = writeRenderEvent(w, clt, &cj)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"uuid": jid,
+				}).Errorf("error writing conversion job event: %v", err)
+
+				return
+			}
+			flusher.Flush()
+			status = cj.Status
+		}
+
+		if cj.isFinished() {
+			return
+		}
+
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+
+			cj, found, err = clt.fetchConversionJob(jid)
+			if err != nil || !found {
+				return
+			}
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,436 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// filesystemObject is what is kept in the sidecar file of a stored file, the
+// details that S3 keeps along with objects
+type filesystemObject struct {
+	ContentType        string            `json:"content_type"`
+	ContentDisposition string            `json:"content_disposition"`
+	Metadata           map[string]string `json:"metadata"`
+}
+
+type filesystemStorage struct {
+	rootDir     string
+	externalURL string
+	secret      []byte
+}
+
+func newFilesystemStorage() *filesystemStorage {
+	return &filesystemStorage{
+		rootDir:     viper.GetString("storage.filesystem_path"),
+		externalURL: strings.TrimSuffix(viper.GetString("server.external_url"), "/"),
+		secret:      []byte(viper.GetString("server.file_url_secret")),
+	}
+}
+
+func (st *filesystemStorage) filePath(key string) (string, error) {
+	// Clean the key as if it were rooted so that it can never point outside of
+	// the storage directory
+	cleanKey := path.Clean("/" + key)
+	if cleanKey == "/" {
+		return "", fmt.Errorf("invalid storage key '%s'", key)
+	}
+
+	return filepath.Join(st.rootDir, filepath.FromSlash(cleanKey)), nil
+}
+
+// sidecarPath returns the path of the file that the details of the file at fp
+// are kept in, it's hidden so that it can't clash with the name of a file
+func sidecarPath(fp string) string {
+	return filepath.Join(filepath.Dir(fp), fmt.Sprintf(".%s.json", filepath.Base(fp)))
+}
+
+func (st *filesystemStorage) locationPath(cj *ConversionJob) (string, error) {
+	_, key, err := parseStorageLocation(FilesystemStorage, cj.StorageLocation)
+	if err != nil {
+		return "", err
+	}
+
+	return st.filePath(key)
+}
+
+func (st *filesystemStorage) Put(cj *ConversionJob, container string, key string, filePath string, obj StorageObject) (string, error) {
+	// Containers map to top-level directories of the storage directory
+	key = path.Join(container, key)
+	location := generateStorageLocation(FilesystemStorage, "", key)
+
+	dst, err := st.filePath(key)
+	if err != nil {
+		return location, err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("start copy of file to storage directory")
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return location, err
+	}
+
+	src, err := os.Open(filePath)
+	if err != nil {
+		return location, err
+	}
+	defer src.Close()
+
+	// Copy to a temporary file first and rename it once done so that a
+	// partially written file is never served
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".upload-")
+	if err != nil {
+		return location, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to copy file: %v", err)
+
+		return location, err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return location, err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return location, err
+	}
+
+	// Write the details of the file first so that they're there once the
+	// file is
+	data, err := json.Marshal(filesystemObject{
+		ContentType:        obj.ContentType,
+		ContentDisposition: obj.ContentDisposition,
+		Metadata:           obj.Metadata,
+	})
+	if err != nil {
+		return location, err
+	}
+
+	err = ioutil.WriteFile(sidecarPath(dst), data, 0644)
+	if err != nil {
+		return location, err
+	}
+
+	err = os.Rename(tmp.Name(), dst)
+	if err != nil {
+		return location, err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("completed copy of file to storage directory")
+
+	return location, nil
+}
+
+func (st *filesystemStorage) Locate(cj *ConversionJob, exp time.Duration) (string, error) {
+	_, key, err := parseStorageLocation(FilesystemStorage, cj.StorageLocation)
+	if err != nil {
+		return "", err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debugln("generating signed url to rendered file")
+
+	// Files are served by job, the name is only there so that clients can
+	// tell what they're downloading
+	name := path.Base(key)
+	expires := time.Now().Add(exp).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", st.sign(cj.Identifier, name, expires))
+
+	route := url.URL{Path: fmt.Sprintf("/files/%s/%s", cj.Identifier, name)}
+	surl := fmt.Sprintf("%s%s?%s", st.externalURL, route.EscapedPath(), query.Encode())
+
+	return surl, nil
+}
+
+func (st *filesystemStorage) Delete(cj *ConversionJob) error {
+	fp, err := st.locationPath(cj)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(fp)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to delete file from storage directory: %v", err)
+
+		return err
+	}
+
+	err = os.Remove(sidecarPath(fp))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to delete details of file from storage directory: %v", err)
+
+		return err
+	}
+
+	// Remove the directory of the job as well, this only succeeds if it's empty
+	os.Remove(filepath.Dir(fp))
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("deleted file from storage directory")
+
+	return nil
+}
+
+func (st *filesystemStorage) Stat(cj *ConversionJob) (StorageObject, error) {
+	obj := StorageObject{}
+
+	fp, err := st.locationPath(cj)
+	if err != nil {
+		return obj, err
+	}
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to fetch details of file from storage directory: %v", err)
+
+		return obj, err
+	}
+
+	obj.Size = fi.Size()
+	obj.ContentType = mime.TypeByExtension(filepath.Ext(fp))
+	obj.ContentDisposition = mime.FormatMediaType("inline", map[string]string{"filename": fi.Name()})
+	obj.ETag = fmt.Sprintf("\"%x-%x\"", fi.ModTime().Unix(), fi.Size())
+	obj.LastModified = fi.ModTime()
+
+	// Files stored before details were kept have no sidecar file, their
+	// details are derived from the file itself
+	data, err := ioutil.ReadFile(sidecarPath(fp))
+	if os.IsNotExist(err) {
+		return obj, nil
+	}
+	if err != nil {
+		return obj, err
+	}
+
+	fo := filesystemObject{}
+	err = json.Unmarshal(data, &fo)
+	if err != nil {
+		return obj, err
+	}
+
+	if fo.ContentType != "" {
+		obj.ContentType = fo.ContentType
+	}
+	if fo.ContentDisposition != "" {
+		obj.ContentDisposition = fo.ContentDisposition
+	}
+	obj.Metadata = fo.Metadata
+
+	return obj, nil
+}
+
+func (st *filesystemStorage) Open(cj *ConversionJob) (StorageReader, StorageObject, error) {
+	obj, err := st.Stat(cj)
+	if err != nil {
+		return nil, obj, err
+	}
+
+	fp, err := st.locationPath(cj)
+	if err != nil {
+		return nil, obj, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to open file in storage directory: %v", err)
+
+		return nil, obj, err
+	}
+
+	return f, obj, nil
+}
+
+func (st *filesystemStorage) sign(jid string, name string, expires int64) string {
+	mac := hmac.New(sha256.New, st.secret)
+	mac.Write([]byte(fmt.Sprintf("%s/%s:%d", jid, name, expires)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (st *filesystemStorage) verify(jid string, name string, expires string, signature string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	if time.Now().Unix() > exp {
+		return false
+	}
+
+	return hmac.Equal([]byte(st.sign(jid, name, exp)), []byte(signature))
+}
+
+func (clt *Client) filesHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	jid := params["uuid"]
+
+	_, err := uuid.FromString(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "invalid job identifier",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	st, ok := clt.storage.(*filesystemStorage)
+	if !ok {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "files are not served by the configured storage backend",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	name := params["name"]
+	query := r.URL.Query()
+	if !st.verify(jid, name, query.Get("expires"), query.Get("signature")) {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "invalid or expired file url signature",
+		}
+		requestForbiddenResponse(&w, r, ers)
+
+		return
+	}
+
+	cj, found, err := clt.fetchConversionJob(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to fetch conversion job",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	// Archives of batches are stored under the identifier of the batch
+	if !found {
+		var b Batch
+		b, found, err = clt.fetchBatch(jid)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: jid,
+				Message:    "unable to fetch batch",
+			}
+			requestInternalServerErrorResponse(&w, r, ers)
+
+			return
+		}
+		cj = b.archiveJob()
+	}
+
+	if !found || cj.StorageLocation == "" {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "rendered file not found",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	fp, err := st.locationPath(&cj)
+	if err != nil || filepath.Base(fp) != name {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "rendered file not found",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	f, obj, err := st.Open(&cj)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "rendered file not found in storage directory",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+	defer f.Close()
+
+	log.WithFields(log.Fields{
+		"uuid": jid,
+	}).Info("serving rendered file from storage directory")
+
+	// Serve the file with the details it was stored with, as S3 would
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", obj.ContentDisposition)
+	}
+
+	http.ServeContent(w, r, name, obj.LastModified, f)
+}
@@ -0,0 +1,180 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// The flags of conversions are generated here rather than with the FlagSets of
+// go-wkhtml because their Generate runs the converter itself. That leaves no
+// way to kill a conversion once its job times out or is cancelled, to pass
+// flags that aren't target options (e.g. '--allow' for bundles) or to render a
+// PDF from several pages along with a cover and a table of contents. The tables
+// below map the JSON keys of wkhtmltox.ImageOptions and wkhtmltox.PDFOptions to
+// the same flags as the FlagSets do, flags_test.go checks them against the
+// fields of those types.
+
+// flagSpec maps a target option to its wkhtmltox flag. Boolean options set
+// flag when true and negated (if any) when false, all other options pass their
+// value to flag. Global options apply to the whole document rather than a page
+type flagSpec struct {
+	flag    string
+	negated string
+	global  bool
+}
+
+var imageFlags = map[string]flagSpec{
+	"cache_dir":                 {flag: "--cache-dir"},
+	"cookie":                    {flag: "--cookie"},
+	"crop_h":                    {flag: "--crop-h"},
+	"crop_w":                    {flag: "--crop-w"},
+	"crop_x":                    {flag: "--crop-x"},
+	"crop_y":                    {flag: "--crop-y"},
+	"custom_header":             {flag: "--custom-header"},
+	"custom_header_propagation": {flag: "--custom-header-propagation", negated: "--no-custom-header-propagation"},
+	"debug_javascript":          {flag: "--debug-javascript", negated: "--no-debug-javascript"},
+	"encoding":                  {flag: "--encoding"},
+	"format":                    {flag: "--format"},
+	"height":                    {flag: "--height"},
+	"images":                    {flag: "--images", negated: "--no-images"},
+	"javascript":                {flag: "--enable-javascript", negated: "--disable-javascript"},
+	"javascript_delay":          {flag: "--javascript-delay"},
+	"load_error_handling":       {flag: "--load-error-handling"},
+	"load_media_error_handling": {flag: "--load-media-error-handling"},
+	"minimum_font_size":         {flag: "--minimum-font-size"},
+	"password":                  {flag: "--password"},
+	"quality":                   {flag: "--quality"},
+	"smart_width":               {flag: "--enable-smart-width", negated: "--disable-smart-width"},
+	"stop_slow_scripts":         {flag: "--stop-slow-scripts", negated: "--no-stop-slow-scripts"},
+	"transparent":               {flag: "--transparent"},
+	"use_xserver":               {flag: "--use-xserver"},
+	"username":                  {flag: "--username"},
+	"width":                     {flag: "--width"},
+	"zoom":                      {flag: "--zoom"},
+}
+
+var pdfFlags = map[string]flagSpec{
+	"cache_dir":                 {flag: "--cache-dir"},
+	"cookie":                    {flag: "--cookie"},
+	"custom_header":             {flag: "--custom-header"},
+	"custom_header_propagation": {flag: "--custom-header-propagation", negated: "--no-custom-header-propagation"},
+	"debug_javascript":          {flag: "--debug-javascript", negated: "--no-debug-javascript"},
+	"dpi":                       {flag: "--dpi", global: true},
+	"encoding":                  {flag: "--encoding"},
+	"external_links":            {flag: "--enable-external-links", negated: "--disable-external-links"},
+	"forms":                     {flag: "--enable-forms", negated: "--disable-forms"},
+	"grayscale":                 {flag: "--grayscale", global: true},
+	"images":                    {flag: "--images", negated: "--no-images"},
+	"image_dpi":                 {flag: "--image-dpi", global: true},
+	"image_quality":             {flag: "--image-quality", global: true},
+	"internal_links":            {flag: "--enable-internal-links", negated: "--disable-internal-links"},
+	"javascript":                {flag: "--enable-javascript", negated: "--disable-javascript"},
+	"javascript_delay":          {flag: "--javascript-delay"},
+	"load_error_handling":       {flag: "--load-error-handling"},
+	"load_media_error_handling": {flag: "--load-media-error-handling"},
+	"lowquality":                {flag: "--lowquality", global: true},
+	"margin_bottom":             {flag: "--margin-bottom", global: true},
+	"margin_left":               {flag: "--margin-left", global: true},
+	"margin_right":              {flag: "--margin-right", global: true},
+	"margin_top":                {flag: "--margin-top", global: true},
+	"minimum_font_size":         {flag: "--minimum-font-size"},
+	"no_pdf_compression":        {flag: "--no-pdf-compression", global: true},
+	"orientation":               {flag: "--orientation", global: true},
+	"page_height":               {flag: "--page-height", global: true},
+	"page_size":                 {flag: "--page-size", global: true},
+	"page_width":                {flag: "--page-width", global: true},
+	"password":                  {flag: "--password"},
+	"smart_width":               {flag: "--enable-smart-shrinking", negated: "--disable-smart-shrinking"},
+	"stop_slow_scripts":         {flag: "--stop-slow-scripts", negated: "--no-stop-slow-scripts"},
+	"title":                     {flag: "--title", global: true},
+	"use_xserver":               {flag: "--use-xserver", global: true},
+	"username":                  {flag: "--username"},
+	"zoom":                      {flag: "--zoom"},
+}
+
+var tocFlags = map[string]flagSpec{
+	"disable_dotted_lines": {flag: "--disable-dotted-lines"},
+	"disable_links":        {flag: "--disable-toc-links"},
+	"header_text":          {flag: "--toc-header-text"},
+	"level_indentation":    {flag: "--toc-level-indentation"},
+	"text_size_shrink":     {flag: "--toc-text-size-shrink"},
+}
+
+// generateFlags translates target options to wkhtmltox flags, options that
+// aren't set are left out so that wkhtmltox uses its defaults
+func generateFlags(opts interface{}, specs map[string]flagSpec) ([]string, error) {
+	var flags []string
+
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return flags, err
+	}
+
+	values := map[string]interface{}{}
+	err = json.Unmarshal(data, &values)
+	if err != nil {
+		return flags, err
+	}
+
+	// Sort the options so that the flags are always in the same order
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		value := values[k]
+		if value == nil {
+			continue
+		}
+
+		spec, ok := specs[k]
+		if !ok {
+			return flags, fmt.Errorf("unsupported option '%s'", k)
+		}
+
+		switch v := value.(type) {
+		case bool:
+			if v {
+				flags = append(flags, spec.flag)
+			} else if spec.negated != "" {
+				flags = append(flags, spec.negated)
+			}
+		case float64:
+			flags = append(flags, spec.flag, strconv.FormatFloat(v, 'f', -1, 64))
+		case string:
+			flags = append(flags, spec.flag, v)
+		case []interface{}:
+			// Lists are of name/value pairs e.g. cookies and custom headers
+			for _, item := range v {
+				pair, ok := item.(map[string]interface{})
+				if !ok {
+					return flags, fmt.Errorf("invalid value of option '%s'", k)
+				}
+				flags = append(flags, spec.flag, fmt.Sprint(pair["name"]), fmt.Sprint(pair["value"]))
+			}
+		default:
+			return flags, fmt.Errorf("invalid value of option '%s'", k)
+		}
+	}
+
+	return flags, nil
+}
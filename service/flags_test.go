@@ -0,0 +1,133 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/itskingori/go-wkhtml/wkhtmltox"
+)
+
+// jsonKeys returns the JSON keys of the fields of a struct type
+func jsonKeys(t reflect.Type) []string {
+	var keys []string
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		keys = append(keys, tag)
+	}
+
+	return keys
+}
+
+func TestFlagTablesMatchOptions(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  interface{}
+		specs map[string]flagSpec
+	}{
+		{name: "image", opts: wkhtmltox.ImageOptions{}, specs: imageFlags},
+		{name: "pdf", opts: wkhtmltox.PDFOptions{}, specs: pdfFlags},
+		{name: "toc", opts: tocOptions{}, specs: tocFlags},
+	}
+
+	for _, tt := range tests {
+		keys := jsonKeys(reflect.TypeOf(tt.opts))
+
+		seen := map[string]bool{}
+		for _, k := range keys {
+			seen[k] = true
+			if _, ok := tt.specs[k]; !ok {
+				t.Errorf("%s: option '%s' has no flag", tt.name, k)
+			}
+		}
+
+		for k, spec := range tt.specs {
+			if !seen[k] {
+				t.Errorf("%s: flag of option '%s' doesn't match any field", tt.name, k)
+			}
+
+			if !strings.HasPrefix(spec.flag, "--") || (spec.negated != "" && !strings.HasPrefix(spec.negated, "--")) {
+				t.Errorf("%s: flag of option '%s' is malformed", tt.name, k)
+			}
+		}
+	}
+}
+
+func TestGenerateFlags(t *testing.T) {
+	specs := map[string]flagSpec{
+		"cookie":     {flag: "--cookie"},
+		"grayscale":  {flag: "--grayscale"},
+		"javascript": {flag: "--enable-javascript", negated: "--disable-javascript"},
+		"title":      {flag: "--title"},
+		"zoom":       {flag: "--zoom"},
+	}
+
+	tests := []struct {
+		name  string
+		opts  map[string]interface{}
+		flags []string
+		err   bool
+	}{
+		{name: "no options"},
+		{name: "unset options", opts: map[string]interface{}{"title": nil, "zoom": nil}},
+		{name: "true", opts: map[string]interface{}{"grayscale": true}, flags: []string{"--grayscale"}},
+		{name: "false without negated flag", opts: map[string]interface{}{"grayscale": false}},
+		{name: "true with negated flag", opts: map[string]interface{}{"javascript": true}, flags: []string{"--enable-javascript"}},
+		{name: "false with negated flag", opts: map[string]interface{}{"javascript": false}, flags: []string{"--disable-javascript"}},
+		{name: "number", opts: map[string]interface{}{"zoom": 1.25}, flags: []string{"--zoom", "1.25"}},
+		{name: "integral number", opts: map[string]interface{}{"zoom": 2}, flags: []string{"--zoom", "2"}},
+		{name: "string", opts: map[string]interface{}{"title": "Invoice 42"}, flags: []string{"--title", "Invoice 42"}},
+		{
+			name:  "pairs",
+			opts:  map[string]interface{}{"cookie": []map[string]string{{"name": "a", "value": "1"}, {"name": "b", "value": "2"}}},
+			flags: []string{"--cookie", "a", "1", "--cookie", "b", "2"},
+		},
+		{
+			name:  "sorted by option",
+			opts:  map[string]interface{}{"zoom": 2, "title": "x", "grayscale": true},
+			flags: []string{"--grayscale", "--title", "x", "--zoom", "2"},
+		},
+		{name: "malformed pairs", opts: map[string]interface{}{"cookie": []string{"a=1"}}, err: true},
+		{name: "object", opts: map[string]interface{}{"title": map[string]string{"a": "b"}}, err: true},
+		{name: "unsupported option", opts: map[string]interface{}{"header_html": "x"}, err: true},
+	}
+
+	for _, tt := range tests {
+		flags, err := generateFlags(tt.opts, specs)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got flags %v", tt.name, flags)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+
+			continue
+		}
+
+		if strings.Join(flags, " ") != strings.Join(tt.flags, " ") {
+			t.Errorf("%s: expected flags %v, got %v", tt.name, tt.flags, flags)
+		}
+	}
+}
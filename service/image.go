@@ -16,6 +16,7 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"path/filepath"
@@ -28,10 +29,15 @@ import (
 type imageRenderRequest struct {
 	Source source                 `json:"source"`
 	Target wkhtmltox.ImageOptions `json:"target"`
+	Output output                 `json:"output"`
+
+	CallbackURL string            `json:"callback_url"`
+	Timeout     int               `json:"timeout"`
+	Labels      map[string]string `json:"labels"`
 }
 
-func (rr *imageRenderRequest) save(riq string, c *Client) (ConversionJob, error) {
-	cj, err := c.createAndSaveConversionJob(riq, rr)
+func (rr *imageRenderRequest) save(riq string, origin jobOrigin, c *Client) (ConversionJob, error) {
+	cj, err := c.createAndSaveConversionJob(riq, origin, rr)
 	if err != nil {
 		log.Error(err)
 
@@ -41,18 +47,84 @@ func (rr *imageRenderRequest) save(riq string, c *Client) (ConversionJob, error)
 	return cj, nil
 }
 
-func (rr *imageRenderRequest) sourceURL() (*url.URL, error) {
-	u, err := url.Parse(rr.Source.URL)
+func (rr *imageRenderRequest) validate() error {
+	err := validateCallbackURL(rr.CallbackURL)
+	if err != nil {
+		return err
+	}
+
+	err = validateTimeout(rr.Timeout)
+	if err != nil {
+		return err
+	}
+
+	err = validateLabels(rr.Labels)
+	if err != nil {
+		return err
+	}
+
+	err = rr.Source.validate()
+	if err != nil {
+		return err
+	}
+
+	return rr.Output.validate()
+}
+
+func (rr *imageRenderRequest) sourceURLs() ([]*url.URL, error) {
+	urls, err := parseSourceURLs(rr.inputSources())
 	if err != nil {
 		log.Error(err)
 
-		return u, err
+		return urls, err
+	}
+
+	return urls, nil
+}
+
+func (rr *imageRenderRequest) sourceOptions() *source {
+	return &rr.Source
+}
+
+func (rr *imageRenderRequest) inputSources() []*source {
+	return []*source{&rr.Source}
+}
+
+func (rr *imageRenderRequest) outputOptions() *output {
+	return &rr.Output
+}
+
+func (rr *imageRenderRequest) callbackURL() string {
+	return rr.CallbackURL
+}
+
+func (rr *imageRenderRequest) timeout() int {
+	return rr.Timeout
+}
+
+func (rr *imageRenderRequest) labels() map[string]string {
+	return rr.Labels
+}
+
+// arguments returns the arguments to wkhtmltoimage to render the request to
+// outputFile
+func (rr *imageRenderRequest) arguments(c *Client, cj *ConversionJob, outputDir string, outputFile string) ([]string, error) {
+	input, inputFlags, err := rr.Source.input(c, cj, outputDir, sourceHTMLFile)
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := generateFlags(rr.Target, imageFlags)
+	if err != nil {
+		return nil, err
 	}
+	args = append(args, inputFlags...)
+	args = append(args, input, outputFile)
 
-	return u, nil
+	return args, nil
 }
 
-func (rr *imageRenderRequest) fulfill(c *Client, cj *ConversionJob, outputDir string) ([]byte, string, error) {
+func (rr *imageRenderRequest) fulfill(ctx context.Context, c *Client, cj *ConversionJob, outputDir string) ([]byte, string, error) {
 	var (
 		outputFile string
 		outputLogs []byte
@@ -62,8 +134,13 @@ func (rr *imageRenderRequest) fulfill(c *Client, cj *ConversionJob, outputDir st
 	ifs := wkhtmltox.NewImageFlagSetFromOptions(&opts)
 	format, _ := ifs.GetFormat()
 	outputFile = filepath.Join(outputDir, fmt.Sprintf("file.%s", format))
-	inputURL := rr.Source.URL
-	outputLogs, err := ifs.Generate(inputURL, outputFile)
+	args, err := rr.arguments(c, cj, outputDir, outputFile)
+	if err != nil {
+		log.Error(err)
+
+		return outputLogs, outputFile, err
+	}
+	outputLogs, err = runConverter(ctx, imageConverter, args)
 	if err != nil {
 		log.Error(err)
 
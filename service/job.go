@@ -17,6 +17,7 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"time"
@@ -29,19 +30,124 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// errJobFinished is returned when saving a transition of a conversion job that
+// has already finished e.g. if it was cancelled while it was processed
+var errJobFinished = errors.New("conversion job has already finished")
+
+// updateJobScript saves the fields of a conversion job that changed, refusing
+// to change the status of jobs that have already finished. ARGV[1] is whether
+// the status changed, the fields follow. It returns -1 if the job doesn't exist
+// (any more), 0 if the change is refused and 1 once it's saved
+var updateJobScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return -1
+end
+if ARGV[1] == '1' then
+  local status = redis.call('HGET', KEYS[1], 'status')
+  if status == 'succeeded' or status == 'failed' or status == 'cancelled' then
+    return 0
+  end
+end
+if #ARGV > 1 then
+  redis.call('HMSET', KEYS[1], unpack(ARGV, 2))
+end
+return 1
+`)
+
+// jobError describes why an attempt at a conversion job failed, the job is
+// retried unless the attempt was the last or retrying won't change the outcome
+type jobError struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Stage       string `json:"stage"`
+	Attempt     int    `json:"attempt"`
+	MaxAttempts int    `json:"max_attempts"`
+}
+
+// jobOrigin is where a render request came from. Held jobs are saved without
+// being enqueued, it's up to whoever saved them to enqueue them
+type jobOrigin struct {
+	client string
+	batch  string
+	held   bool
+}
+
 // ConversionJob is a mapping of a conversion job's attributes
 type ConversionJob struct {
-	Identifier    string `redis:"uuid"`
-	CreatedAt     string `redis:"created_at"`
-	StartedAt     string `redis:"started_at"`
-	EndedAt       string `redis:"ended_at"`
-	ExpiresIn     int    `redis:"expires_in"`
-	Status        string `redis:"status"`
-	Logs          []byte `redis:"logs"`
-	StorageBucket string `redis:"storage_bucket"`
-	StorageKey    string `redis:"storage_key"`
-	RequestType   string `redis:"request_type"`
-	RequestData   []byte `redis:"request_data"`
+	Identifier      string `redis:"uuid"`
+	CreatedAt       string `redis:"created_at"`
+	StartedAt       string `redis:"started_at"`
+	EndedAt         string `redis:"ended_at"`
+	ExpiresIn       int    `redis:"expires_in"`
+	Status          string `redis:"status"`
+	Logs            []byte `redis:"logs"`
+	StorageLocation string `redis:"storage_location"`
+	RequestType     string `redis:"request_type"`
+	RequestData     []byte `redis:"request_data"`
+	Timeout         int    `redis:"timeout"`
+	Client          string `redis:"client"`
+	Labels          []byte `redis:"labels"`
+	Batch           string `redis:"batch"`
+
+	// Delivery of the callback once the job is done, if it has one
+	CallbackURL      string `redis:"callback_url"`
+	CallbackStatus   string `redis:"callback_status"`
+	CallbackAttempts []byte `redis:"callback_attempts"`
+
+	// Why the last attempt at the job failed, if it did
+	Error []byte `redis:"error"`
+
+	// Where jobs saved before storage locations were introduced stored their
+	// file in S3, see fetchConversionJob
+	StorageBucket string `redis:"storage_bucket,omitempty"`
+	StorageKey    string `redis:"storage_key,omitempty"`
+
+	// transitioned is set when the status changes, so that the transition is
+	// published once the change is saved
+	transitioned bool
+
+	// saved are the fields of the job as they were last fetched or saved, so
+	// that updates only save the fields that changed
+	saved map[string]string
+}
+
+// flattenConversionJob returns the fields of the conversion job as they're
+// saved in redis
+func flattenConversionJob(cj *ConversionJob) map[string]string {
+	fields := map[string]string{}
+
+	args := redis.Args{}.AddFlat(cj)
+	for i := 0; i+1 < len(args); i += 2 {
+		name := fmt.Sprint(args[i])
+		switch v := args[i+1].(type) {
+		case []byte:
+			fields[name] = string(v)
+		default:
+			fields[name] = fmt.Sprint(v)
+		}
+	}
+
+	return fields
+}
+
+func (cj *ConversionJob) renderRequest() (renderRequest, error) {
+	var rR renderRequest
+
+	switch cj.RequestType {
+	case "*service.imageRenderRequest":
+		rR = &imageRenderRequest{}
+	case "*service.pdfRenderRequest":
+		rR = &pdfRenderRequest{}
+	default:
+		return rR, fmt.Errorf("invalid render target type '%s'", cj.RequestType)
+	}
+
+	err := json.Unmarshal(cj.RequestData, rR)
+	if err != nil {
+		return rR, err
+	}
+
+	return rR, nil
 }
 
 func generateJobKey(jid string) string {
@@ -53,24 +159,79 @@ func generateJobKey(jid string) string {
 func (cj *ConversionJob) markAsProcessing() {
 	cj.StartedAt = time.Now().UTC().Format(time.RFC3339)
 	cj.Status = "processing"
+	cj.transitioned = true
 
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
 	}).Info("marked conversion job as 'processing'")
 }
 
-func (cj *ConversionJob) markAsFailed() {
+func (cj *ConversionJob) setError(jerr jobError) {
+	data, err := json.Marshal(jerr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("unable to marshal job error: %v", err)
+
+		return
+	}
+	cj.Error = data
+}
+
+func (cj *ConversionJob) jobError() *jobError {
+	if len(cj.Error) == 0 {
+		return nil
+	}
+
+	jerr := &jobError{}
+	err := json.Unmarshal(cj.Error, jerr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("unable to unmarshal job error: %v", err)
+
+		return nil
+	}
+
+	return jerr
+}
+
+func (cj *ConversionJob) markAsRetrying(jerr jobError) {
+	cj.Status = "retrying"
+	cj.setError(jerr)
+	cj.transitioned = true
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("marked conversion job as 'retrying'")
+}
+
+func (cj *ConversionJob) markAsFailed(jerr jobError) {
 	cj.EndedAt = time.Now().UTC().Format(time.RFC3339)
 	cj.Status = "failed"
+	cj.setError(jerr)
+	cj.transitioned = true
 
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
 	}).Info("marked conversion job as 'failed'")
 }
 
+func (cj *ConversionJob) markAsCancelled() {
+	cj.EndedAt = time.Now().UTC().Format(time.RFC3339)
+	cj.Status = "cancelled"
+	cj.transitioned = true
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("marked conversion job as 'cancelled'")
+}
+
 func (cj *ConversionJob) markAsSucceeded() {
 	cj.EndedAt = time.Now().UTC().Format(time.RFC3339)
 	cj.Status = "succeeded"
+	cj.Error = nil
+	cj.transitioned = true
 
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
@@ -88,7 +249,7 @@ func (clt *Client) enqueueConversionJob(riq string) error {
 	return nil
 }
 
-func (clt *Client) createAndSaveConversionJob(rid string, rR renderRequest) (ConversionJob, error) {
+func (clt *Client) createAndSaveConversionJob(rid string, origin jobOrigin, rR renderRequest) (ConversionJob, error) {
 	cj := ConversionJob{}
 	rt := viper.GetInt("server.request_ttl")
 	key := generateJobKey(rid)
@@ -104,6 +265,19 @@ func (clt *Client) createAndSaveConversionJob(rid string, rR renderRequest) (Con
 	cj.Status = "pending"
 	cj.RequestType = reflect.TypeOf(rR).String()
 	cj.RequestData = serializedRequest
+	cj.Timeout = conversionTimeout(rR)
+	cj.Client = origin.client
+	cj.Batch = origin.batch
+	if len(rR.labels()) > 0 {
+		cj.Labels, err = json.Marshal(rR.labels())
+		if err != nil {
+			return cj, err
+		}
+	}
+	cj.CallbackURL = rR.callbackURL()
+	if cj.CallbackURL != "" {
+		cj.CallbackStatus = "pending"
+	}
 
 	conn := clt.redisPool.Get()
 	defer conn.Close()
@@ -129,6 +303,16 @@ func (clt *Client) createAndSaveConversionJob(rid string, rR renderRequest) (Con
 
 		return cj, err
 	}
+	cj.saved = flattenConversionJob(&cj)
+
+	err = clt.indexConversionJob(&cj)
+	if err != nil {
+		return cj, err
+	}
+
+	if origin.held {
+		return cj, nil
+	}
 
 	err = clt.enqueueConversionJob(rid)
 	if err != nil {
@@ -169,6 +353,13 @@ func (clt *Client) fetchConversionJob(jid string) (ConversionJob, bool, error) {
 	}
 	found = true
 
+	// Jobs that succeeded before storage locations were introduced only have
+	// the bucket and key their file was uploaded to
+	if cj.StorageLocation == "" && cj.StorageBucket != "" && cj.StorageKey != "" {
+		cj.StorageLocation = generateStorageLocation(S3Storage, cj.StorageBucket, cj.StorageKey)
+	}
+	cj.saved = flattenConversionJob(&cj)
+
 	log.WithFields(log.Fields{
 		"uuid": jid,
 	}).Debug("fetched conversion job details")
@@ -176,6 +367,10 @@ func (clt *Client) fetchConversionJob(jid string) (ConversionJob, bool, error) {
 	return cj, found, nil
 }
 
+// updateConversionJob saves the fields of the conversion job that changed since
+// it was fetched or saved. Transitions of jobs that have already finished are
+// refused with errJobFinished, so that e.g. a worker can't overwrite a
+// cancellation with its own outcome
 func (clt *Client) updateConversionJob(cj *ConversionJob) error {
 	conn := clt.redisPool.Get()
 	defer conn.Close()
@@ -189,9 +384,17 @@ func (clt *Client) updateConversionJob(cj *ConversionJob) error {
 		return err
 	}
 
-	job := *cj
-	key := generateJobKey(uid.String())
-	_, err = conn.Do("HMSET", redis.Args{}.Add(key).AddFlat(&job)...)
+	fields := flattenConversionJob(cj)
+	statusChanged := cj.saved == nil || cj.saved["status"] != fields["status"]
+
+	args := redis.Args{}.Add(generateJobKey(uid.String()), statusChanged)
+	for name, value := range fields {
+		if saved, ok := cj.saved[name]; !ok || saved != value {
+			args = args.Add(name, value)
+		}
+	}
+
+	res, err := redis.Int(updateJobScript.Do(conn, args...))
 	if err != nil {
 		log.WithFields(log.Fields{
 			"uuid": cj.Identifier,
@@ -200,9 +403,34 @@ func (clt *Client) updateConversionJob(cj *ConversionJob) error {
 		return err
 	}
 
+	switch res {
+	case -1:
+		return fmt.Errorf("conversion job not found, it may have expired")
+	case 0:
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Infof("conversion job has already finished, not marking it as '%s'", cj.Status)
+
+		return errJobFinished
+	}
+	cj.saved = fields
+
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
 	}).Debug("saved conversion job changes")
 
+	// Let anyone waiting on the job know that its status changed, failing to
+	// do so isn't fatal since they can still poll its status
+	if cj.transitioned {
+		clt.indexConversionJobStatus(cj)
+		clt.publishJobEvent(cj)
+		cj.transitioned = false
+
+		// Batches finish once all their jobs do
+		if cj.Batch != "" && cj.isFinished() {
+			clt.finishBatchJob(cj)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,521 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// clientHeader is the header that identifies the client making a request
+	// e.g. the API key set by a gateway in front of the server
+	clientHeader = "X-Sanaa-Client"
+
+	// maxClientLength is the maximum length of the client identifier
+	maxClientLength = 255
+
+	// maxLabels is the maximum number of labels a render request can set
+	maxLabels = 20
+
+	// maxLabelValueLength is the maximum length of the value of a label
+	maxLabelValueLength = 255
+
+	// defaultJobsLimit is the number of jobs listed per page by default
+	defaultJobsLimit = 20
+
+	// maxJobsLimit is the maximum number of jobs that can be listed per page
+	maxJobsLimit = 100
+
+	// jobsQueryTTL is how long the intersection of indexes made to list jobs
+	// is kept for, in case the server doesn't get to delete it
+	jobsQueryTTL = 60
+)
+
+// labelNamePattern is what the names of labels of render requests have to
+// match
+var labelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,62}$`)
+
+// jobStatuses are all the statuses a conversion job can have, each has an index
+var jobStatuses = []string{"pending", "processing", "retrying", "failed", "succeeded", "cancelled"}
+
+// jobsFilter is what conversion jobs are listed by
+type jobsFilter struct {
+	status        string
+	client        string
+	labels        map[string]string
+	createdAfter  float64
+	createdBefore float64
+	ascending     bool
+	limit         int
+	cursor        jobsCursor
+}
+
+// jobsCursor is where a page of conversion jobs starts i.e. at the jobs
+// created at score, after skipping offset of them that were already listed
+type jobsCursor struct {
+	score  float64
+	offset int
+}
+
+// jobResponse is a conversion job as it's listed i.e. its render response
+// without the URL to the rendered file, which these fields shadow
+type jobResponse struct {
+	renderResponse
+	FileURL          string `json:"file_url,omitempty"`
+	FileURLExpiresAt string `json:"file_url_expires_at,omitempty"`
+}
+
+type jobsResponse struct {
+	Jobs       []jobResponse `json:"jobs"`
+	NextCursor string        `json:"next_cursor"`
+}
+
+func generateJobsIndexKey() string {
+	key := fmt.Sprintf("%s:jobs", viper.GetString("redis.namespace"))
+
+	return key
+}
+
+func generateJobsStatusIndexKey(status string) string {
+	key := fmt.Sprintf("%s:jobs:status:%s", viper.GetString("redis.namespace"), status)
+
+	return key
+}
+
+func generateJobsClientIndexKey(client string) string {
+	key := fmt.Sprintf("%s:jobs:client:%s", viper.GetString("redis.namespace"), client)
+
+	return key
+}
+
+func generateJobsLabelIndexKey(name string, value string) string {
+	key := fmt.Sprintf("%s:jobs:label:%s:%s", viper.GetString("redis.namespace"), name, value)
+
+	return key
+}
+
+func generateJobsQueryKey() string {
+	key := fmt.Sprintf("%s:jobs:query:%s", viper.GetString("redis.namespace"), uuid.NewV4().String())
+
+	return key
+}
+
+// parseClient returns the client that made the request, if it's identified
+func parseClient(r *http.Request) (string, error) {
+	client := strings.TrimSpace(r.Header.Get(clientHeader))
+	if len(client) > maxClientLength {
+		return client, fmt.Errorf("%s header is %d characters long, yet the maximum is %d", clientHeader, len(client), maxClientLength)
+	}
+
+	return client, nil
+}
+
+// validateLabels validates the labels that a render request can be searched by
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("request has %d labels, yet the maximum is %d", len(labels), maxLabels)
+	}
+
+	for name, value := range labels {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid label name '%s', it has to be lowercase letters, digits, '_', '.' or '-'", name)
+		}
+
+		if value == "" || len(value) > maxLabelValueLength {
+			return fmt.Errorf("invalid value of label '%s', it has to be 1 to %d characters long", name, maxLabelValueLength)
+		}
+	}
+
+	return nil
+}
+
+// jobScore returns the score of the conversion job in the indexes i.e. when it
+// was created
+func jobScore(cj *ConversionJob) float64 {
+	createdAt, err := time.Parse(time.RFC3339, cj.CreatedAt)
+	if err != nil {
+		return 0
+	}
+
+	return float64(createdAt.Unix())
+}
+
+// jobsCutoff returns the score before which jobs that are kept for ttl seconds
+// have expired
+func jobsCutoff(ttl int) float64 {
+	return float64(time.Now().Unix() - int64(ttl))
+}
+
+func (cj *ConversionJob) labels() map[string]string {
+	labels := map[string]string{}
+
+	if len(cj.Labels) == 0 {
+		return labels
+	}
+
+	err := json.Unmarshal(cj.Labels, &labels)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("unable to unmarshal labels: %v", err)
+	}
+
+	return labels
+}
+
+// indexConversionJob adds a new conversion job to the indexes it's listed by.
+// Indexes outlive the jobs in them, so expired jobs are pruned as others are
+// added
+func (clt *Client) indexConversionJob(cj *ConversionJob) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	keys := []string{
+		generateJobsIndexKey(),
+		generateJobsStatusIndexKey(cj.Status),
+	}
+	if cj.Client != "" {
+		keys = append(keys, generateJobsClientIndexKey(cj.Client))
+	}
+	for name, value := range cj.labels() {
+		keys = append(keys, generateJobsLabelIndexKey(name, value))
+	}
+
+	score := jobScore(cj)
+	cutoff := jobsCutoff(cj.ExpiresIn)
+
+	conn.Send("MULTI")
+	for _, key := range keys {
+		conn.Send("ZADD", key, score, cj.Identifier)
+		conn.Send("ZREMRANGEBYSCORE", key, "-inf", fmt.Sprintf("(%v", cutoff))
+	}
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error("error indexing conversion job")
+
+		return err
+	}
+
+	return nil
+}
+
+// indexConversionJobStatus moves the conversion job to the index of its
+// current status
+func (clt *Client) indexConversionJobStatus(cj *ConversionJob) error {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	cutoff := jobsCutoff(cj.ExpiresIn)
+
+	conn.Send("MULTI")
+	for _, status := range jobStatuses {
+		if status != cj.Status {
+			conn.Send("ZREM", generateJobsStatusIndexKey(status), cj.Identifier)
+		}
+	}
+	key := generateJobsStatusIndexKey(cj.Status)
+	conn.Send("ZADD", key, jobScore(cj), cj.Identifier)
+	conn.Send("ZREMRANGEBYSCORE", key, "-inf", fmt.Sprintf("(%v", cutoff))
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error("error indexing conversion job status")
+
+		return err
+	}
+
+	return nil
+}
+
+func encodeJobsCursor(c jobsCursor) string {
+	value := fmt.Sprintf("%d:%d", int64(c.score), c.offset)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+func decodeJobsCursor(value string) (jobsCursor, error) {
+	c := jobsCursor{}
+
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor '%s'", value)
+	}
+
+	parts := strings.Split(string(data), ":")
+	if len(parts) != 2 {
+		return c, fmt.Errorf("invalid cursor '%s'", value)
+	}
+
+	score, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return c, fmt.Errorf("invalid cursor '%s'", value)
+	}
+
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil || offset < 0 {
+		return c, fmt.Errorf("invalid cursor '%s'", value)
+	}
+	c.score = float64(score)
+	c.offset = offset
+
+	return c, nil
+}
+
+// parseJobsFilter parses the query parameters of a request to list jobs
+func parseJobsFilter(r *http.Request) (jobsFilter, error) {
+	query := r.URL.Query()
+	filter := jobsFilter{
+		status:        query.Get("status"),
+		client:        query.Get("client"),
+		labels:        map[string]string{},
+		createdAfter:  math.Inf(-1),
+		createdBefore: math.Inf(1),
+		limit:         defaultJobsLimit,
+		cursor:        jobsCursor{score: math.NaN()},
+	}
+
+	// Clients identified by the gateway can only list their own jobs
+	client, err := parseClient(r)
+	if err != nil {
+		return filter, err
+	}
+	if client != "" {
+		filter.client = client
+	}
+
+	if filter.status != "" {
+		known := false
+		for _, status := range jobStatuses {
+			if filter.status == status {
+				known = true
+			}
+		}
+
+		if !known {
+			return filter, fmt.Errorf("invalid status '%s', it has to be one of %s", filter.status, strings.Join(jobStatuses, ", "))
+		}
+	}
+
+	for _, label := range query["label"] {
+		parts := strings.SplitN(label, ":", 2)
+		if len(parts) != 2 {
+			return filter, fmt.Errorf("invalid label '%s', set it as name:value", label)
+		}
+		filter.labels[parts[0]] = parts[1]
+	}
+
+	for param, bound := range map[string]*float64{
+		"created_after":  &filter.createdAfter,
+		"created_before": &filter.createdBefore,
+	} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s '%s', it has to be an RFC3339 timestamp", param, value)
+		}
+		*bound = float64(t.Unix())
+	}
+
+	switch query.Get("sort") {
+	case "", "-created_at":
+	case "created_at":
+		filter.ascending = true
+	default:
+		return filter, fmt.Errorf("invalid sort '%s', it has to be either created_at or -created_at", query.Get("sort"))
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxJobsLimit {
+			return filter, fmt.Errorf("invalid limit '%s', it has to be between 1 and %d", value, maxJobsLimit)
+		}
+		filter.limit = limit
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeJobsCursor(value)
+		if err != nil {
+			return filter, err
+		}
+		filter.cursor = cursor
+	}
+
+	return filter, nil
+}
+
+// listConversionJobs lists the conversion jobs that match the filter, along
+// with the cursor to the next page if there may be one
+func (clt *Client) listConversionJobs(filter jobsFilter) ([]ConversionJob, string, error) {
+	var jobs []ConversionJob
+
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	keys := []string{}
+	if filter.status != "" {
+		keys = append(keys, generateJobsStatusIndexKey(filter.status))
+	}
+	if filter.client != "" {
+		keys = append(keys, generateJobsClientIndexKey(filter.client))
+	}
+	for name, value := range filter.labels {
+		keys = append(keys, generateJobsLabelIndexKey(name, value))
+	}
+
+	// Jobs have to be in every index that's filtered by, all of which have
+	// the same scores
+	key := generateJobsIndexKey()
+	switch len(keys) {
+	case 0:
+	case 1:
+		key = keys[0]
+	default:
+		key = generateJobsQueryKey()
+		args := redis.Args{}.Add(key, len(keys)).AddFlat(keys).Add("AGGREGATE", "MAX")
+		conn.Send("MULTI")
+		conn.Send("ZINTERSTORE", args...)
+		conn.Send("EXPIRE", key, jobsQueryTTL)
+		_, err := conn.Do("EXEC")
+		if err != nil {
+			return jobs, "", err
+		}
+		defer conn.Do("DEL", key)
+	}
+
+	// Leave out expired jobs, their entries in the indexes may not have been
+	// pruned yet
+	min := math.Max(filter.createdAfter, jobsCutoff(viper.GetInt("server.request_ttl")))
+	max := filter.createdBefore
+	offset := 0
+	if !math.IsNaN(filter.cursor.score) {
+		offset = filter.cursor.offset
+		if filter.ascending {
+			min = math.Max(min, filter.cursor.score)
+		} else {
+			max = math.Min(max, filter.cursor.score)
+		}
+	}
+
+	var (
+		values []interface{}
+		err    error
+	)
+	if filter.ascending {
+		values, err = redis.Values(conn.Do("ZRANGEBYSCORE", key, min, max, "WITHSCORES", "LIMIT", offset, filter.limit))
+	} else {
+		values, err = redis.Values(conn.Do("ZREVRANGEBYSCORE", key, max, min, "WITHSCORES", "LIMIT", offset, filter.limit))
+	}
+	if err != nil {
+		return jobs, "", err
+	}
+
+	ids := []string{}
+	scores := []float64{}
+	for i := 0; i+1 < len(values); i += 2 {
+		id, _ := redis.String(values[i], nil)
+		score, _ := redis.Float64(values[i+1], nil)
+		ids = append(ids, id)
+		scores = append(scores, score)
+	}
+
+	// There may be more jobs if the page is full, the next page starts after
+	// the jobs listed that were created at the same time as the last one
+	cursor := ""
+	if len(ids) == filter.limit {
+		last := jobsCursor{score: scores[len(scores)-1]}
+		for i := len(scores) - 1; i >= 0 && scores[i] == last.score; i-- {
+			last.offset++
+		}
+
+		if last.offset == len(scores) && last.score == filter.cursor.score {
+			last.offset += filter.cursor.offset
+		}
+		cursor = encodeJobsCursor(last)
+	}
+
+	for _, id := range ids {
+		cj, found, err := clt.fetchConversionJob(id)
+		if err != nil {
+			return jobs, "", err
+		}
+
+		if !found {
+			continue
+		}
+		jobs = append(jobs, cj)
+	}
+
+	return jobs, cursor, nil
+}
+
+func (clt *Client) listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	filter, err := parseJobsFilter(r)
+	if err != nil {
+		ers = errorResponse{
+			Message: err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	jobs, cursor, err := clt.listConversionJobs(filter)
+	if err != nil {
+		log.Errorf("error listing conversion jobs: %v", err)
+
+		ers = errorResponse{
+			Message: "unable to list conversion jobs",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	jrs := jobsResponse{
+		Jobs:       []jobResponse{},
+		NextCursor: cursor,
+	}
+	for i := range jobs {
+		jrs.Jobs = append(jrs.Jobs, jobResponse{
+			renderResponse: jobs[i].summarizeRenderResponse(),
+		})
+	}
+
+	requestJSONResponse(&w, r, http.StatusOK, jrs)
+}
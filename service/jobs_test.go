@@ -0,0 +1,119 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeJobsCursor(t *testing.T) {
+	encode := func(value string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    jobsCursor
+		wantErr bool
+	}{
+		{"round trip", encodeJobsCursor(jobsCursor{score: 1517897949, offset: 3}), jobsCursor{score: 1517897949, offset: 3}, false},
+		{"zero offset", encode("1517897949:0"), jobsCursor{score: 1517897949}, false},
+		{"not base64", "not base64!", jobsCursor{}, true},
+		{"empty", encode(""), jobsCursor{}, true},
+		{"missing offset", encode("1517897949"), jobsCursor{}, true},
+		{"extra part", encode("1517897949:3:1"), jobsCursor{}, true},
+		{"non-numeric score", encode("yesterday:3"), jobsCursor{}, true},
+		{"fractional score", encode("1517897949.5:3"), jobsCursor{}, true},
+		{"non-numeric offset", encode("1517897949:three"), jobsCursor{}, true},
+		{"negative offset", encode("1517897949:-1"), jobsCursor{}, true},
+		{"empty offset", encode("1517897949:"), jobsCursor{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeJobsCursor(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseJobsFilterClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"no client", "/jobs", "", "", false},
+		{"client parameter", "/jobs?client=acme", "", "acme", false},
+		{"client header", "/jobs", "acme", "acme", false},
+		{"other client parameter", "/jobs?client=other", "acme", "acme", false},
+		{"malformed cursor", "/jobs?cursor=not-a-cursor", "", "", true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.query, nil)
+		if tt.header != "" {
+			r.Header.Set(clientHeader, tt.header)
+		}
+
+		filter, err := parseJobsFilter(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+		if !tt.wantErr && filter.client != tt.want {
+			t.Errorf("%s: got client '%s', want '%s'", tt.name, filter.client, tt.want)
+		}
+	}
+}
+
+func TestJobResponseLeavesOutFileURL(t *testing.T) {
+	jr := jobResponse{
+		renderResponse: renderResponse{
+			Identifier:       "21835d4a-5dfc-41a4-a798-21980baa43c9",
+			FileURL:          "https://example.com/file.png",
+			FileURLExpiresAt: "2018-02-24T00:46:31Z",
+		},
+	}
+
+	data, err := json.Marshal(jr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]interface{}{}
+	json.Unmarshal(data, &fields)
+	for _, name := range []string{"file_url", "file_url_expires_at"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("listed job has %s: %s", name, data)
+		}
+	}
+	if fields["uuid"] != jr.Identifier {
+		t.Errorf("listed job is missing its uuid: %s", data)
+	}
+}
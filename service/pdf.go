@@ -16,21 +16,128 @@
 package service
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
 
 	"github.com/itskingori/go-wkhtml/wkhtmltox"
+	"github.com/spf13/viper"
 
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// MaxPDFSources is the maximum number of sources that a PDF can be
+	// rendered from
+	MaxPDFSources = 100
+
+	// pdfPartsDir is the directory in the working directory of the job that
+	// headers, footers and the TOC style sheet are written to
+	pdfPartsDir = "parts"
+)
+
+// xslNamespace is the namespace of the elements of XSL style sheets
+const xslNamespace = "http://www.w3.org/1999/XSL/Transform"
+
+// xslDeniedElements are the XSL elements that TOC style sheets can't have since
+// they load or write other files
+var xslDeniedElements = map[string]bool{
+	"include":         true,
+	"import":          true,
+	"import-schema":   true,
+	"result-document": true,
+}
+
+// xslDeniedFunctions matches calls (prefixed or not, and followed by a comment
+// or not) to the XPath functions that TOC style sheets can't use since they
+// read other files or URLs
+var xslDeniedFunctions = regexp.MustCompile(`(^|[^\w.:-])([\w.-]+:)?(doc|doc-available|document|unparsed-text|unparsed-text-available|unparsed-text-lines|collection|uri-collection)\s*\(`)
+
+// pageNumberScript is appended to inline headers and footers. It replaces the
+// content of elements with the class of a variable that wkhtmltopdf passes in
+// the query string of headers and footers e.g. 'page' and 'topage'
+const pageNumberScript = `
+<script>
+(function() {
+  var vars = {};
+  var query = document.location.search.substring(1).split('&');
+  for (var i = 0; i < query.length; i++) {
+    var pair = query[i].split('=', 2);
+    vars[pair[0]] = decodeURIComponent(pair[1] || '');
+  }
+  var keys = ['page', 'frompage', 'topage', 'webpage', 'section', 'subsection',
+    'subsubsection', 'date', 'isodate', 'time', 'title', 'doctitle', 'sitepage',
+    'sitepages'];
+  for (var k = 0; k < keys.length; k++) {
+    var elements = document.getElementsByClassName(keys[k]);
+    for (var j = 0; j < elements.length; j++) {
+      elements[j].textContent = vars[keys[k]];
+    }
+  }
+})();
+</script>
+`
+
 type pdfRenderRequest struct {
-	Source source               `json:"source"`
-	Target wkhtmltox.PDFOptions `json:"target"`
+	Source  source               `json:"source"`
+	Sources []pageSource         `json:"sources"`
+	Cover   *pageSource          `json:"cover"`
+	TOC     *tableOfContents     `json:"toc"`
+	Header  *headerFooter        `json:"header"`
+	Footer  *headerFooter        `json:"footer"`
+	Target  wkhtmltox.PDFOptions `json:"target"`
+	Output  output               `json:"output"`
+
+	CallbackURL string            `json:"callback_url"`
+	Timeout     int               `json:"timeout"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// tableOfContents is the table of contents of a PDF, it's placed after the
+// cover (if any) and before the pages
+type tableOfContents struct {
+	XSL     string     `json:"xsl"`
+	Options tocOptions `json:"options"`
+}
+
+type tocOptions struct {
+	HeaderText         string  `json:"header_text,omitempty"`
+	DisableDottedLines bool    `json:"disable_dotted_lines,omitempty"`
+	DisableLinks       bool    `json:"disable_links,omitempty"`
+	LevelIndentation   string  `json:"level_indentation,omitempty"`
+	TextSizeShrink     float64 `json:"text_size_shrink,omitempty"`
+}
+
+// headerFooter is the source of the header or footer of every page of a PDF
+type headerFooter struct {
+	source
+	Spacing float64 `json:"spacing"`
+}
+
+// pageSource is the source of one of the pages of a PDF rendered from several
+// sources, along with target options that only apply to it
+type pageSource struct {
+	source
+	Options map[string]interface{} `json:"options"`
+}
+
+func (ps *pageSource) validate() error {
+	if ps.Bundle {
+		return fmt.Errorf("sources can't have a bundle")
+	}
+
+	return ps.source.validate()
 }
 
-func (rr *pdfRenderRequest) save(riq string, c *Client) (ConversionJob, error) {
-	cj, err := c.createAndSaveConversionJob(riq, rr)
+func (rr *pdfRenderRequest) save(riq string, origin jobOrigin, c *Client) (ConversionJob, error) {
+	cj, err := c.createAndSaveConversionJob(riq, origin, rr)
 	if err != nil {
 		log.Error(err)
 
@@ -40,28 +147,333 @@ func (rr *pdfRenderRequest) save(riq string, c *Client) (ConversionJob, error) {
 	return cj, nil
 }
 
-func (rr *pdfRenderRequest) sourceURL() (*url.URL, error) {
-	u, err := url.Parse(rr.Source.URL)
+func (toc *tableOfContents) validate() error {
+	if toc.XSL == "" {
+		return nil
+	}
+
+	maxHTMLSize := viper.GetInt("server.max_html_size")
+	if len(toc.XSL) > maxHTMLSize {
+		return fmt.Errorf("toc xsl is %d bytes, yet the maximum is %d bytes", len(toc.XSL), maxHTMLSize)
+	}
+
+	// The style sheet is run by wkhtmltopdf, make sure it can't read files on
+	// the worker or fetch URLs the source policy doesn't allow
+	decoder := xml.NewDecoder(bytes.NewReader([]byte(toc.XSL)))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("toc xsl is not valid XML, %v", err)
+		}
+
+		switch t := token.(type) {
+		case xml.Directive:
+			return fmt.Errorf("toc xsl can't have a document type declaration")
+		case xml.StartElement:
+			if t.Name.Space == xslNamespace && xslDeniedElements[t.Name.Local] {
+				return fmt.Errorf("toc xsl can't have xsl:%s elements", t.Name.Local)
+			}
+
+			for _, attr := range t.Attr {
+				match := xslDeniedFunctions.FindStringSubmatch(attr.Value)
+				if match != nil {
+					return fmt.Errorf("toc xsl can't call the %s() function", match[3])
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (hf *headerFooter) validate() error {
+	if hf.Bundle {
+		return fmt.Errorf("can't have a bundle")
+	}
+
+	return hf.source.validate()
+}
+
+// input writes inline headers and footers along with the page number script
+// and returns the flags to pass to wkhtmltopdf
+func (hf *headerFooter) input(c *Client, cj *ConversionJob, workDir string, kind string) ([]string, error) {
+	name := fmt.Sprintf("%s.html", kind)
+	input, flags, err := hf.source.input(c, cj, workDir, name)
+	if err != nil {
+		return flags, err
+	}
+
+	if hf.HTML != "" || hf.Template != "" {
+		f, err := os.OpenFile(input, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return flags, err
+		}
+
+		_, err = f.WriteString(pageNumberScript)
+		f.Close()
+		if err != nil {
+			return flags, err
+		}
+	}
+
+	flags = append(flags, fmt.Sprintf("--%s-html", kind), input)
+	if hf.Spacing != 0 {
+		flags = append(flags, fmt.Sprintf("--%s-spacing", kind), fmt.Sprint(hf.Spacing))
+	}
+
+	return flags, nil
+}
+
+func (rr *pdfRenderRequest) validate() error {
+	// Options of the cover and sources are free-form, check them all at once
+	// so that every offending one is reported
+	var errs []fieldError
+	if rr.Cover != nil {
+		errs = append(errs, checkOptions("cover.options", rr.Cover.Options, pdfFlags, pdfRules, true)...)
+	}
+	for i, ps := range rr.Sources {
+		errs = append(errs, checkOptions(fmt.Sprintf("sources[%d].options", i), ps.Options, pdfFlags, pdfRules, true)...)
+	}
+	if len(errs) > 0 {
+		return &validationError{fields: errs}
+	}
+
+	err := validateCallbackURL(rr.CallbackURL)
+	if err != nil {
+		return err
+	}
+
+	err = validateTimeout(rr.Timeout)
+	if err != nil {
+		return err
+	}
+
+	err = validateLabels(rr.Labels)
+	if err != nil {
+		return err
+	}
+
+	if rr.Cover != nil {
+		err := rr.Cover.validate()
+		if err != nil {
+			return fmt.Errorf("invalid cover, %v", err)
+		}
+	}
+
+	if rr.TOC != nil {
+		err := rr.TOC.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if rr.Header != nil {
+		err := rr.Header.validate()
+		if err != nil {
+			return fmt.Errorf("invalid header, %v", err)
+		}
+	}
+
+	if rr.Footer != nil {
+		err := rr.Footer.validate()
+		if err != nil {
+			return fmt.Errorf("invalid footer, %v", err)
+		}
+	}
+
+	if len(rr.Sources) == 0 {
+		err := rr.Source.validate()
+		if err != nil {
+			return err
+		}
+
+		return rr.Output.validate()
+	}
+
+	if rr.Source.isSet() {
+		return fmt.Errorf("request can't have both a source and sources")
+	}
+
+	if len(rr.Sources) > MaxPDFSources {
+		return fmt.Errorf("request has %d sources, yet the maximum is %d", len(rr.Sources), MaxPDFSources)
+	}
+
+	for i := range rr.Sources {
+		err := rr.Sources[i].validate()
+		if err != nil {
+			return fmt.Errorf("invalid source %d, %v", i+1, err)
+		}
+	}
+
+	return rr.Output.validate()
+}
+
+func (rr *pdfRenderRequest) sourceURLs() ([]*url.URL, error) {
+	urls, err := parseSourceURLs(rr.inputSources())
 	if err != nil {
 		log.Error(err)
 
-		return u, err
+		return urls, err
+	}
+
+	return urls, nil
+}
+
+func (rr *pdfRenderRequest) sourceOptions() *source {
+	return &rr.Source
+}
+
+func (rr *pdfRenderRequest) inputSources() []*source {
+	var srcs []*source
+
+	if rr.Cover != nil {
+		srcs = append(srcs, &rr.Cover.source)
+	}
+
+	if len(rr.Sources) == 0 {
+		srcs = append(srcs, &rr.Source)
+	}
+
+	for i := range rr.Sources {
+		srcs = append(srcs, &rr.Sources[i].source)
+	}
+
+	if rr.Header != nil {
+		srcs = append(srcs, &rr.Header.source)
+	}
+
+	if rr.Footer != nil {
+		srcs = append(srcs, &rr.Footer.source)
+	}
+
+	return srcs
+}
+
+func (rr *pdfRenderRequest) outputOptions() *output {
+	return &rr.Output
+}
+
+func (rr *pdfRenderRequest) callbackURL() string {
+	return rr.CallbackURL
+}
+
+func (rr *pdfRenderRequest) timeout() int {
+	return rr.Timeout
+}
+
+func (rr *pdfRenderRequest) labels() map[string]string {
+	return rr.Labels
+}
+
+// arguments returns the arguments to wkhtmltopdf to render the request to
+// outputFile
+func (rr *pdfRenderRequest) arguments(c *Client, cj *ConversionJob, outputDir string, outputFile string) ([]string, error) {
+	// Options of the target come before the pages so that they apply to all of
+	// them, options of a page follow its input
+	args, err := generateFlags(rr.Target, pdfFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	partsDir := filepath.Join(outputDir, pdfPartsDir)
+	err = os.MkdirAll(partsDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	kinds := []string{"header", "footer"}
+	for i, hf := range []*headerFooter{rr.Header, rr.Footer} {
+		if hf == nil {
+			continue
+		}
+
+		hfFlags, err := hf.input(c, cj, partsDir, kinds[i])
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, hfFlags...)
+	}
+
+	if rr.Cover != nil {
+		input, inputFlags, err := rr.Cover.input(c, cj, partsDir, "cover.html")
+		if err != nil {
+			return nil, err
+		}
+
+		coverFlags, err := generateFlags(rr.Cover.Options, pdfFlags)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "cover", input)
+		args = append(args, coverFlags...)
+		args = append(args, inputFlags...)
+	}
+
+	if rr.TOC != nil {
+		tocArgs, err := generateFlags(rr.TOC.Options, tocFlags)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "toc")
+		args = append(args, tocArgs...)
+
+		if rr.TOC.XSL != "" {
+			xslFile := filepath.Join(partsDir, "toc.xsl")
+			err = ioutil.WriteFile(xslFile, []byte(rr.TOC.XSL), 0600)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, "--xsl-style-sheet", xslFile)
+		}
+	}
+
+	if len(rr.Sources) == 0 {
+		input, inputFlags, err := rr.Source.input(c, cj, outputDir, sourceHTMLFile)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "page")
+		args = append(args, input)
+		args = append(args, inputFlags...)
+	}
+
+	for i, ps := range rr.Sources {
+		input, inputFlags, err := ps.input(c, cj, outputDir, fmt.Sprintf("source-%d.html", i+1))
+		if err != nil {
+			return nil, err
+		}
+
+		pageFlags, err := generateFlags(ps.Options, pdfFlags)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "page", input)
+		args = append(args, pageFlags...)
+		args = append(args, inputFlags...)
 	}
 
-	return u, nil
+	args = append(args, outputFile)
+
+	return args, nil
 }
 
-func (rr *pdfRenderRequest) fulfill(c *Client, cj *ConversionJob, outputDir string) ([]byte, string, error) {
+func (rr *pdfRenderRequest) fulfill(ctx context.Context, c *Client, cj *ConversionJob, outputDir string) ([]byte, string, error) {
 	var (
 		outputFile string
 		outputLogs []byte
 	)
 
-	opts := rr.Target
-	pfs := wkhtmltox.NewPDFFlagSetFromOptions(&opts)
 	outputFile = filepath.Join(outputDir, "file.pdf")
-	inputURL := rr.Source.URL
-	outputLogs, err := pfs.Generate(inputURL, outputFile)
+	args, err := rr.arguments(c, cj, outputDir, outputFile)
+	if err != nil {
+		log.Error(err)
+
+		return outputLogs, outputFile, err
+	}
+	outputLogs, err = runConverter(ctx, pdfConverter, args)
 	if err != nil {
 		log.Error(err)
 
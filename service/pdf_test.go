@@ -0,0 +1,65 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestTableOfContentsValidate(t *testing.T) {
+	viper.Set("server.max_html_size", 65536)
+	defer viper.Set("server.max_html_size", nil)
+
+	xsl := func(body string) string {
+		return `<?xml version="1.0" encoding="UTF-8"?>
+<xsl:stylesheet version="2.0" xmlns:xsl="http://www.w3.org/1999/XSL/Transform" xmlns:outline="http://wkhtmltopdf.org/outline">
+` + body + `
+</xsl:stylesheet>`
+	}
+
+	tests := []struct {
+		name    string
+		xsl     string
+		wantErr bool
+	}{
+		{"none", "", false},
+		{"plain", xsl(`<xsl:template match="outline:item"><li><xsl:value-of select="@title"/></li></xsl:template>`), false},
+		{"similar function names", xsl(`<xsl:template match="/"><xsl:value-of select="my-doc(@title), documents"/></xsl:template>`), false},
+		{"not xml", "<xsl:stylesheet", true},
+		{"doctype", `<!DOCTYPE x [<!ENTITY e SYSTEM "file:///etc/passwd">]>` + xsl(""), true},
+		{"include", xsl(`<xsl:include href="file:///etc/passwd"/>`), true},
+		{"import", xsl(`<xsl:import href="https://example.com/toc.xsl"/>`), true},
+		{"result document", xsl(`<xsl:template match="/"><xsl:result-document href="/tmp/out"/></xsl:template>`), true},
+		{"doc", xsl(`<xsl:template match="/"><xsl:copy-of select="doc('file:///etc/passwd')"/></xsl:template>`), true},
+		{"prefixed doc", xsl(`<xsl:template match="/"><xsl:copy-of select="fn:doc('file:///etc/passwd')" xmlns:fn="http://www.w3.org/2005/xpath-functions"/></xsl:template>`), true},
+		{"document", xsl(`<xsl:template match="/"><xsl:copy-of select="document('file:///etc/passwd')"/></xsl:template>`), true},
+		{"unparsed text", xsl(`<xsl:template match="/"><xsl:value-of select="unparsed-text('/proc/self/environ')"/></xsl:template>`), true},
+		{"spaced call", xsl(`<xsl:template match="/"><xsl:value-of select="unparsed-text ('/proc/self/environ')"/></xsl:template>`), true},
+		{"commented call", xsl(`<xsl:template match="/"><xsl:value-of select="doc(: x :)('file:///etc/passwd')"/></xsl:template>`), true},
+		{"escaped call", xsl(`<xsl:template match="/"><xsl:value-of select="d&#111;c('file:///etc/passwd')"/></xsl:template>`), true},
+		{"attribute value template", xsl(`<xsl:template match="/"><a href="{doc('http://169.254.169.254/')}"/></xsl:template>`), true},
+	}
+
+	for _, tt := range tests {
+		toc := tableOfContents{XSL: tt.xsl}
+		err := toc.validate()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
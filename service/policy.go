@@ -0,0 +1,344 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// sourceDialTimeout is how long connecting to the address of a source host can
+// take
+const sourceDialTimeout = 30 * time.Second
+
+// privateCIDRs are ranges that aren't reachable over the internet i.e.
+// private, loopback, link-local, shared and unspecified addresses. Sources are
+// blocked from resolving to them unless allowed
+var privateCIDRs = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// sourcePolicyError is returned when a source URL isn't allowed, denied is set
+// if the URL is valid but the policy doesn't allow it to be fetched
+type sourcePolicyError struct {
+	message string
+	denied  bool
+}
+
+func (e *sourcePolicyError) Error() string {
+	return e.message
+}
+
+// sourcePolicy decides which URLs workers are allowed to fetch sources from,
+// to keep them from being used to reach internal services
+type sourcePolicy struct {
+	schemes      []string
+	allowedHosts []string
+	deniedHosts  []string
+	allowedCIDRs []*net.IPNet
+	deniedCIDRs  []*net.IPNet
+	privateCIDRs []*net.IPNet
+	allowPrivate bool
+}
+
+// ParseCIDRs parses a list of CIDR blocks e.g. 10.0.0.0/8
+func ParseCIDRs(blocks []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+
+	for _, block := range blocks {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(block))
+		if err != nil {
+			return nets, fmt.Errorf("invalid CIDR block '%s'", block)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func newSourcePolicy() (*sourcePolicy, error) {
+	sp := &sourcePolicy{
+		allowPrivate: viper.GetBool("source.allow_private"),
+	}
+
+	for _, scheme := range viper.GetStringSlice("source.allowed_schemes") {
+		sp.schemes = append(sp.schemes, strings.ToLower(strings.TrimSpace(scheme)))
+	}
+
+	for _, host := range viper.GetStringSlice("source.allowed_hosts") {
+		sp.allowedHosts = append(sp.allowedHosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+
+	for _, host := range viper.GetStringSlice("source.denied_hosts") {
+		sp.deniedHosts = append(sp.deniedHosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+
+	var err error
+	sp.allowedCIDRs, err = ParseCIDRs(viper.GetStringSlice("source.allowed_cidrs"))
+	if err != nil {
+		return sp, err
+	}
+
+	sp.deniedCIDRs, err = ParseCIDRs(viper.GetStringSlice("source.denied_cidrs"))
+	if err != nil {
+		return sp, err
+	}
+
+	sp.privateCIDRs, err = ParseCIDRs(privateCIDRs)
+	if err != nil {
+		return sp, err
+	}
+
+	return sp, nil
+}
+
+// matchHost returns whether the host matches any of the patterns, which are
+// either a host name e.g. 'example.com' or a wildcard for its subdomains e.g.
+// '*.example.com'
+func matchHost(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+
+			continue
+		}
+
+		if host == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchIP(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkScheme returns an error if the scheme isn't allowed by the policy
+func (sp *sourcePolicy) checkScheme(scheme string) error {
+	for _, s := range sp.schemes {
+		if strings.ToLower(scheme) == s {
+			return nil
+		}
+	}
+
+	return &sourcePolicyError{
+		message: fmt.Sprintf("source url scheme '%s' is not allowed, the allowed schemes are %s", scheme, strings.Join(sp.schemes, ", ")),
+	}
+}
+
+// checkHost returns an error if the host name isn't allowed by the policy,
+// regardless of what it resolves to
+func (sp *sourcePolicy) checkHost(host string) error {
+	if matchHost(host, sp.deniedHosts) {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("source host '%s' is denied", host),
+			denied:  true,
+		}
+	}
+
+	if len(sp.allowedHosts) > 0 && !matchHost(host, sp.allowedHosts) {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("source host '%s' is not allowed", host),
+			denied:  true,
+		}
+	}
+
+	return nil
+}
+
+// checkIP returns an error if the address that the host resolves to isn't
+// allowed by the policy
+func (sp *sourcePolicy) checkIP(host string, ip net.IP) error {
+	if matchIP(ip, sp.deniedCIDRs) {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("source host '%s' resolves to the denied address %s", host, ip),
+			denied:  true,
+		}
+	}
+
+	// Explicitly allowed addresses are exempt from the private block
+	if matchIP(ip, sp.allowedCIDRs) {
+		return nil
+	}
+
+	if len(sp.allowedCIDRs) > 0 {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("source host '%s' resolves to %s, which is not allowed", host, ip),
+			denied:  true,
+		}
+	}
+
+	if !sp.allowPrivate && matchIP(ip, sp.privateCIDRs) {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("source host '%s' resolves to the private address %s", host, ip),
+			denied:  true,
+		}
+	}
+
+	return nil
+}
+
+// resolve returns the addresses that the host resolves to, or an error if the
+// host or any of its addresses isn't allowed by the policy
+func (sp *sourcePolicy) resolve(host string) ([]net.IP, error) {
+	// A trailing dot makes the name fully qualified, it resolves the same
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return nil, &sourcePolicyError{
+			message: "source url has no host",
+		}
+	}
+
+	err := sp.checkHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return nil, &sourcePolicyError{
+				message: fmt.Sprintf("unable to resolve source host '%s'", host),
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		err = sp.checkIP(host, ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ips, nil
+}
+
+// check returns an error if the URL isn't allowed by the policy. Hosts are
+// resolved and every address they resolve to has to be allowed
+func (sp *sourcePolicy) check(u *url.URL) error {
+	err := sp.checkScheme(u.Scheme)
+	if err != nil {
+		return err
+	}
+
+	if u.Hostname() == "" {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("source url '%s' has no host", u.String()),
+		}
+	}
+
+	_, err = sp.resolve(u.Hostname())
+
+	return err
+}
+
+// dialContext connects to the address only if the policy allows its host. It
+// connects to the addresses that were checked, so that a host can't resolve to
+// an allowed address when checked and to a denied one when connected to e.g.
+// via DNS rebinding
+func (sp *sourcePolicy) dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := sp.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	dialer := net.Dialer{Timeout: sourceDialTimeout}
+	for _, ip := range ips {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// checkSources checks the URLs of all the sources of the render request
+// against the source policy
+func (clt *Client) checkSources(rR renderRequest) error {
+	urls, err := rR.sourceURLs()
+	if err != nil {
+		return &sourcePolicyError{
+			message: fmt.Sprintf("invalid source url, %v", err),
+		}
+	}
+
+	for _, u := range urls {
+		err = clt.sourcePolicy.check(u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseSourceURLs parses the URLs of the sources that have one
+func parseSourceURLs(srcs []*source) ([]*url.URL, error) {
+	var urls []*url.URL
+
+	for _, src := range srcs {
+		if src.URL == "" {
+			continue
+		}
+
+		u, err := url.Parse(src.URL)
+		if err != nil {
+			return urls, err
+		}
+		urls = append(urls, u)
+	}
+
+	return urls, nil
+}
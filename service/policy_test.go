@@ -0,0 +1,210 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newTestSourcePolicy returns a source policy that allows the default schemes
+func newTestSourcePolicy(t *testing.T, sp sourcePolicy, allowedCIDRs []string, deniedCIDRs []string) *sourcePolicy {
+	var err error
+
+	sp.schemes = []string{"http", "https"}
+	sp.allowedCIDRs, err = ParseCIDRs(allowedCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.deniedCIDRs, err = ParseCIDRs(deniedCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.privateCIDRs, err = ParseCIDRs(privateCIDRs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &sp
+}
+
+func TestMatchHost(t *testing.T) {
+	patterns := []string{"example.com", "*.example.org"}
+
+	tests := []struct {
+		host  string
+		match bool
+	}{
+		{host: "example.com", match: true},
+		{host: "www.example.com", match: false},
+		{host: "example.com.evil.net", match: false},
+		{host: "notexample.com", match: false},
+		{host: "www.example.org", match: true},
+		{host: "a.b.example.org", match: true},
+		{host: "example.org", match: false},
+		{host: "evilexample.org", match: false},
+		{host: "example.org.evil.net", match: false},
+	}
+
+	for _, tt := range tests {
+		if match := matchHost(tt.host, patterns); match != tt.match {
+			t.Errorf("%s: expected match to be %v, got %v", tt.host, tt.match, match)
+		}
+	}
+}
+
+func TestSourcePolicyCheck(t *testing.T) {
+	const (
+		allowed = "allowed"
+		denied  = "denied"
+		invalid = "invalid"
+	)
+
+	defaults := newTestSourcePolicy(t, sourcePolicy{}, nil, nil)
+	private := newTestSourcePolicy(t, sourcePolicy{allowPrivate: true}, nil, []string{"10.0.0.0/8"})
+	cidrs := newTestSourcePolicy(t, sourcePolicy{}, []string{"10.0.0.0/8", "93.184.216.0/24"}, []string{"10.1.0.0/16"})
+	hosts := newTestSourcePolicy(t, sourcePolicy{
+		allowedHosts: []string{"example.com", "*.example.com"},
+		deniedHosts:  []string{"admin.example.com", "*.internal"},
+	}, nil, nil)
+
+	tests := []struct {
+		name   string
+		policy *sourcePolicy
+		url    string
+		want   string
+	}{
+		{name: "public v4", policy: defaults, url: "http://93.184.216.34/", want: allowed},
+		{name: "public v6", policy: defaults, url: "https://[2606:2800:220:1:248:1893:25c8:1946]:8443/", want: allowed},
+		{name: "loopback", policy: defaults, url: "http://127.0.0.1:6379/", want: denied},
+		{name: "loopback v6", policy: defaults, url: "http://[::1]/", want: denied},
+		{name: "v4 mapped loopback", policy: defaults, url: "http://[::ffff:127.0.0.1]/", want: denied},
+		{name: "unspecified", policy: defaults, url: "http://0.0.0.0/", want: denied},
+		{name: "private class a", policy: defaults, url: "http://10.1.2.3/", want: denied},
+		{name: "private class b", policy: defaults, url: "http://172.16.0.1/", want: denied},
+		{name: "private class c", policy: defaults, url: "http://192.168.1.1/", want: denied},
+		{name: "shared", policy: defaults, url: "http://100.64.0.1/", want: denied},
+		{name: "link-local metadata", policy: defaults, url: "http://169.254.169.254/latest/meta-data/", want: denied},
+		{name: "unique local v6", policy: defaults, url: "http://[fd00::1]/", want: denied},
+		{name: "link-local v6", policy: defaults, url: "http://[fe80::1]/", want: denied},
+		{name: "scheme not allowed", policy: defaults, url: "ftp://93.184.216.34/", want: invalid},
+		{name: "file scheme", policy: defaults, url: "file:///etc/passwd", want: invalid},
+		{name: "no host", policy: defaults, url: "http:///index.html", want: invalid},
+		{name: "private allowed", policy: private, url: "http://127.0.0.1/", want: allowed},
+		{name: "private allowed but denied cidr", policy: private, url: "http://10.1.2.3/", want: denied},
+		{name: "allowed cidr exempts private", policy: cidrs, url: "http://10.2.0.1/", want: allowed},
+		{name: "allowed public cidr", policy: cidrs, url: "http://93.184.216.34/", want: allowed},
+		{name: "denied cidr within allowed cidr", policy: cidrs, url: "http://10.1.0.1/", want: denied},
+		{name: "outside allowed cidrs", policy: cidrs, url: "http://8.8.8.8/", want: denied},
+		{name: "private outside allowed cidrs", policy: cidrs, url: "http://192.168.1.1/", want: denied},
+		{name: "host not allowed", policy: hosts, url: "http://example.net/", want: denied},
+		{name: "address not an allowed host", policy: hosts, url: "http://93.184.216.34/", want: denied},
+		{name: "host suffix not allowed", policy: hosts, url: "http://example.com.evil.net/", want: denied},
+		{name: "denied host within allowed wildcard", policy: hosts, url: "http://admin.example.com/", want: denied},
+		{name: "denied host with trailing dot", policy: hosts, url: "http://admin.example.com./", want: denied},
+		{name: "denied host in upper case", policy: hosts, url: "http://ADMIN.Example.com/", want: denied},
+		{name: "denied wildcard host", policy: hosts, url: "http://db.internal/", want: denied},
+	}
+
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := allowed
+		err = tt.policy.check(u)
+		if perr, ok := err.(*sourcePolicyError); ok && perr.denied {
+			got = denied
+		} else if err != nil {
+			got = invalid
+		}
+
+		if got != tt.want {
+			t.Errorf("%s: expected %s to be %s, got %s (%v)", tt.name, tt.url, tt.want, got, err)
+		}
+	}
+}
+
+func TestSourceProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer ts.Close()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer tlsServer.Close()
+
+	tests := []struct {
+		name   string
+		policy *sourcePolicy
+		url    string
+		status int
+		err    bool
+	}{
+		{name: "http to loopback denied", policy: newTestSourcePolicy(t, sourcePolicy{}, nil, nil), url: ts.URL, status: http.StatusForbidden},
+		{name: "http to loopback allowed", policy: newTestSourcePolicy(t, sourcePolicy{allowPrivate: true}, nil, nil), url: ts.URL, status: http.StatusOK},
+		{name: "https to loopback denied", policy: newTestSourcePolicy(t, sourcePolicy{}, nil, nil), url: tlsServer.URL, err: true},
+		{name: "https to loopback allowed", policy: newTestSourcePolicy(t, sourcePolicy{allowPrivate: true}, nil, nil), url: tlsServer.URL, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		proxyURL, err := startSourceProxy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pu, err := url.Parse(proxyURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := tlsServer.Client()
+		client.Transport.(*http.Transport).Proxy = http.ProxyURL(pu)
+
+		resp, err := client.Get(tt.url)
+		if tt.err {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: expected an error, got status %d", tt.name, resp.StatusCode)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+
+			continue
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.name, tt.status, resp.StatusCode)
+		}
+
+		if tt.status == http.StatusOK && string(body) != "internal" {
+			t.Errorf("%s: expected the body of the server, got '%s'", tt.name, body)
+		}
+	}
+}
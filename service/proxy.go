@@ -0,0 +1,206 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceProxyURL is the URL of the source proxy of the worker, conversions are
+// passed it via '--proxy' once it's started
+var sourceProxyURL string
+
+// hopHeaders are headers that only apply to a single connection, they aren't
+// passed on by the source proxy
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// sourceProxy is an HTTP proxy that conversions load everything through, so
+// that the source policy applies to all of it i.e. redirects, the assets that
+// pages load and whatever inline HTML, templates and bundles reference, not
+// only to the URLs of sources. Plain HTTP requests are forwarded and HTTPS is
+// tunnelled via CONNECT, either way to the addresses the policy checked
+type sourceProxy struct {
+	policy    *sourcePolicy
+	transport *http.Transport
+}
+
+func newSourceProxy(sp *sourcePolicy) *sourceProxy {
+	return &sourceProxy{
+		policy: sp,
+		transport: &http.Transport{
+			DialContext:           sp.dialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// startSourceProxy starts a source proxy on a random port of the loopback
+// interface and returns its URL
+func startSourceProxy(sp *sourcePolicy) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	go http.Serve(l, newSourceProxy(sp))
+
+	return fmt.Sprintf("http://%s", l.Addr()), nil
+}
+
+func (p *sourceProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+
+		return
+	}
+
+	p.forward(w, r)
+}
+
+// refuse responds to a request that the source proxy won't pass on, with 403
+// Forbidden if the policy denied it
+func (p *sourceProxy) refuse(w http.ResponseWriter, target string, err error) {
+	status := http.StatusBadGateway
+	if perr, ok := err.(*sourcePolicyError); ok && perr.denied {
+		status = http.StatusForbidden
+	}
+
+	log.WithFields(log.Fields{
+		"target": target,
+	}).Warnf("source proxy refused request: %v", err)
+	http.Error(w, err.Error(), status)
+}
+
+// forward passes a plain HTTP request on and copies back the response
+func (p *sourceProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.IsAbs() {
+		http.Error(w, "request url has to be absolute", http.StatusBadRequest)
+
+		return
+	}
+
+	err := p.policy.checkScheme(r.URL.Scheme)
+	if err != nil {
+		p.refuse(w, r.URL.String(), err)
+
+		return
+	}
+
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	out.Header = make(http.Header)
+	for k, v := range r.Header {
+		out.Header[k] = v
+	}
+	for _, h := range hopHeaders {
+		out.Header.Del(h)
+	}
+
+	// The host is checked when the transport connects to it
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.refuse(w, r.URL.String(), err)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel connects the client to the host of a CONNECT request e.g. to fetch a
+// page over HTTPS
+func (p *sourceProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	err := p.policy.checkScheme("https")
+	if err != nil {
+		p.refuse(w, r.Host, err)
+
+		return
+	}
+
+	upstream, err := p.policy.dialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.refuse(w, r.Host, err)
+
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunnelling is not supported", http.StatusInternalServerError)
+
+		return
+	}
+
+	conn, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+
+		return
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		upstream.Close()
+
+		return
+	}
+
+	// The client may have sent more than the request before the tunnel was
+	// established, it's buffered
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, buf.Reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+
+	// Either side closing ends the tunnel
+	<-done
+	conn.Close()
+	upstream.Close()
+}
@@ -0,0 +1,445 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MinS3UploadPartSize is the minimum size of each part of a multipart
+	// upload to S3, in megabytes
+	MinS3UploadPartSize = 5
+
+	// MinS3UploadConcurrency is the minimum number of parts of a multipart
+	// upload to S3 that can be uploaded at a time
+	MinS3UploadConcurrency = 1
+
+	// MinS3UploadTimeout is the minimum time an upload to S3 is allowed to
+	// take, in seconds
+	MinS3UploadTimeout = 1
+
+	// MinS3UploadPartRetries is the minimum number of times to retry uploading
+	// a part of a multipart upload to S3
+	MinS3UploadPartRetries = 0
+
+	// S3EncryptionNone disables server-side encryption of stored files
+	S3EncryptionNone = "none"
+
+	// S3EncryptionS3 encrypts stored files with keys managed by S3 (SSE-S3)
+	S3EncryptionS3 = "sse-s3"
+
+	// S3EncryptionKMS encrypts stored files with a key managed by AWS KMS
+	// (SSE-KMS)
+	S3EncryptionKMS = "sse-kms"
+
+	// S3EncryptionCustomer encrypts stored files with a key provided by us
+	// (SSE-C)
+	S3EncryptionCustomer = "sse-c"
+
+	// S3EncryptionCustomerKeySize is the size of the key used with SSE-C, in
+	// bytes
+	S3EncryptionCustomerKeySize = 32
+)
+
+// S3EncryptionModes is a list of all supported server-side encryption modes
+var S3EncryptionModes = []string{S3EncryptionNone, S3EncryptionS3, S3EncryptionKMS, S3EncryptionCustomer}
+
+type s3Storage struct {
+	awsSession        *session.Session
+	bucket            string
+	uploadPartSize    int64
+	uploadConcurrency int
+	uploadTimeout     time.Duration
+	uploadPartRetries int
+	encryption        string
+	kmsKeyID          string
+	customerKey       string
+	externalURL       string
+}
+
+func newS3Storage() (*s3Storage, error) {
+	cfg := aws.NewConfig()
+
+	// Point at an S3 compatible service e.g. MinIO or Ceph RGW if an endpoint
+	// is set, otherwise the endpoint is resolved from the region
+	endpoint := viper.GetString("storage.s3_endpoint")
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	region := viper.GetString("storage.s3_region")
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+
+	cfg = cfg.WithS3ForcePathStyle(viper.GetBool("storage.s3_force_path_style"))
+
+	// Static credentials take precedence over the ones sourced from the
+	// environment, shared credentials file or EC2 instance role
+	accessKeyID := viper.GetString("storage.s3_access_key_id")
+	secretAccessKey := viper.GetString("storage.s3_secret_access_key")
+	if accessKeyID != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""))
+	}
+
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	// The SDK expects the raw SSE-C key, it takes care of encoding it and
+	// computing its MD5 digest
+	customerKey, err := base64.StdEncoding.DecodeString(viper.GetString("storage.s3_sse_customer_key"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 SSE-C customer key, it's not valid base64: %v", err)
+	}
+
+	st := &s3Storage{
+		awsSession:        sess,
+		bucket:            viper.GetString("worker.s3_bucket"),
+		uploadPartSize:    viper.GetInt64("worker.s3_upload_part_size") * 1024 * 1024,
+		uploadConcurrency: viper.GetInt("worker.s3_upload_concurrency"),
+		uploadTimeout:     time.Duration(viper.GetInt("worker.s3_upload_timeout")) * time.Second,
+		uploadPartRetries: viper.GetInt("worker.s3_upload_part_retries"),
+		encryption:        viper.GetString("storage.s3_sse"),
+		kmsKeyID:          viper.GetString("storage.s3_sse_kms_key_id"),
+		customerKey:       string(customerKey),
+		externalURL:       strings.TrimSuffix(viper.GetString("server.external_url"), "/"),
+	}
+
+	return st, nil
+}
+
+func (st *s3Storage) Put(cj *ConversionJob, container string, key string, filePath string, obj StorageObject) (string, error) {
+	bucket := st.bucket
+	if container != "" {
+		bucket = container
+	}
+	location := generateStorageLocation(S3Storage, bucket, key)
+
+	// Upload in parts read straight off the file so that memory use stays flat
+	// regardless of the size of the file, each part is retried on its own
+	uploader := s3manager.NewUploader(st.awsSession, func(u *s3manager.Uploader) {
+		u.PartSize = st.uploadPartSize
+		u.Concurrency = st.uploadConcurrency
+		u.RequestOptions = append(u.RequestOptions, func(r *request.Request) {
+			r.Retryer = client.DefaultRetryer{NumMaxRetries: st.uploadPartRetries}
+		})
+	})
+
+	// Create a context with a timeout that will abort the upload if it takes more
+	// than the passed in timeout
+	ctx := context.Background()
+	ctx, cancelFn := context.WithTimeout(ctx, st.uploadTimeout)
+
+	// Ensure the context is canceled to prevent leaking. See context package for
+	// more information, https://golang.org/pkg/context/
+	defer cancelFn()
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debug("open file in working directory")
+	file, err := os.Open(filePath)
+	if err != nil {
+		return location, err
+	}
+	defer file.Close()
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("start upload of file to S3")
+
+	// Uploads the object to S3 ... the Context will interrupt the request if the
+	// timeout expires
+	input := &s3manager.UploadInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(key),
+		Body:               file,
+		ContentType:        aws.String(obj.ContentType),
+		ContentDisposition: aws.String(obj.ContentDisposition),
+		Metadata:           aws.StringMap(obj.Metadata),
+	}
+
+	switch st.encryption {
+	case S3EncryptionS3:
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	case S3EncryptionKMS:
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if st.kmsKeyID != "" {
+			input.SSEKMSKeyId = aws.String(st.kmsKeyID)
+		}
+	case S3EncryptionCustomer:
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(st.customerKey)
+	}
+
+	_, err = uploader.UploadWithContext(ctx, input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
+			// If the SDK can determine the request or retry delay was canceled
+			// by a context the CanceledErrorCode error code will be returned
+			log.WithFields(log.Fields{
+				"uuid": cj.Identifier,
+			}).Errorf("upload cancelled due to timeout: %v", err)
+		} else {
+			log.WithFields(log.Fields{
+				"uuid": cj.Identifier,
+			}).Errorf("failed to upload file: %v", err)
+		}
+
+		return location, err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("completed upload of file to S3")
+
+	return location, nil
+}
+
+func (st *s3Storage) Locate(cj *ConversionJob, exp time.Duration) (string, error) {
+	svc := s3.New(st.awsSession)
+
+	bucket, key, err := parseStorageLocation(S3Storage, cj.StorageLocation)
+	if err != nil {
+		return "", err
+	}
+
+	// Files encrypted with SSE-C can only be fetched by passing the key, which
+	// can't be shared with clients, so they're streamed through the server
+	// instead. Files encrypted with SSE-S3 or SSE-KMS need no extra parameters
+	// since URLs are signed with signature version 4
+	if st.encryption == S3EncryptionCustomer {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Debugln("generating download url to rendered file")
+
+		route := url.URL{Path: fmt.Sprintf("/download/%s", cj.Identifier)}
+
+		return st.externalURL + route.EscapedPath(), nil
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	req, _ := svc.GetObjectRequest(input)
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debugln("generating pre-signed url to rendered file")
+
+	url, err := req.Presign(exp)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error("failed to pre-sign url")
+
+		return url, err
+	}
+
+	return url, nil
+}
+
+func (st *s3Storage) Delete(cj *ConversionJob) error {
+	svc := s3.New(st.awsSession)
+
+	bucket, key, err := parseStorageLocation(S3Storage, cj.StorageLocation)
+	if err != nil {
+		return err
+	}
+
+	_, err = svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to delete file from S3: %v", err)
+
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Info("deleted file from S3")
+
+	return nil
+}
+
+func (st *s3Storage) Stat(cj *ConversionJob) (StorageObject, error) {
+	svc := s3.New(st.awsSession)
+	obj := StorageObject{}
+
+	bucket, key, err := parseStorageLocation(S3Storage, cj.StorageLocation)
+	if err != nil {
+		return obj, err
+	}
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+
+	if st.encryption == S3EncryptionCustomer {
+		input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+		input.SSECustomerKey = aws.String(st.customerKey)
+	}
+
+	out, err := svc.HeadObject(input)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("failed to fetch details of file from S3: %v", err)
+
+		return obj, err
+	}
+
+	obj.Size = aws.Int64Value(out.ContentLength)
+	obj.ContentType = aws.StringValue(out.ContentType)
+	obj.ContentDisposition = aws.StringValue(out.ContentDisposition)
+	obj.Metadata = aws.StringValueMap(out.Metadata)
+	obj.ETag = aws.StringValue(out.ETag)
+	obj.LastModified = aws.TimeValue(out.LastModified)
+
+	return obj, nil
+}
+
+func (st *s3Storage) Open(cj *ConversionJob) (StorageReader, StorageObject, error) {
+	obj, err := st.Stat(cj)
+	if err != nil {
+		return nil, obj, err
+	}
+
+	bucket, key, err := parseStorageLocation(S3Storage, cj.StorageLocation)
+	if err != nil {
+		return nil, obj, err
+	}
+
+	reader := &s3ObjectReader{
+		storage: st,
+		svc:     s3.New(st.awsSession),
+		bucket:  bucket,
+		key:     key,
+		size:    obj.Size,
+	}
+
+	return reader, obj, nil
+}
+
+// s3ObjectReader reads an object from S3, fetching it from the current offset
+// only when read so that seeking doesn't transfer any data
+type s3ObjectReader struct {
+	storage *s3Storage
+	svc     *s3.S3
+	bucket  string
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(r.bucket),
+			Key:    aws.String(r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+		}
+
+		if r.storage.encryption == S3EncryptionCustomer {
+			input.SSECustomerAlgorithm = aws.String(s3.ServerSideEncryptionAes256)
+			input.SSECustomerKey = aws.String(r.storage.customerKey)
+		}
+
+		out, err := r.svc.GetObject(input)
+		if err != nil {
+			return 0, err
+		}
+		r.body = out.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var next int64
+
+	switch whence {
+	case io.SeekStart:
+		next = offset
+	case io.SeekCurrent:
+		next = r.offset + offset
+	case io.SeekEnd:
+		next = r.size + offset
+	default:
+		return r.offset, errors.New("invalid whence")
+	}
+
+	if next < 0 {
+		return r.offset, errors.New("negative position")
+	}
+
+	// Drop the current response, the next read fetches from the new offset
+	if next != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = next
+
+	return r.offset, nil
+}
+
+func (r *s3ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+
+	return err
+}
@@ -16,10 +16,15 @@
 package service
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -34,32 +39,238 @@ import (
 const (
 	// MinRequestTTL in the minimum TTL that we should allow to be set on requests
 	MinRequestTTL = 300
+
+	// MinURLTTL is the minimum TTL that we should allow to be set on URLs to
+	// rendered files
+	MinURLTTL = 60
+
+	// MaxURLTTL is the maximum TTL that we should allow to be set on URLs to
+	// rendered files, S3 doesn't accept pre-signed URLs valid for longer
+	MaxURLTTL = 604800
+
+	// MinMaxHTMLSize is the minimum that the maximum size of inline HTML
+	// sources can be set to, in bytes
+	MinMaxHTMLSize = 1024
+
+	// sourceHTMLFile is the name of the file that inline HTML sources are
+	// written to in the working directory of the job
+	sourceHTMLFile = "source.html"
 )
 
 type source struct {
-	URL string `json:"url"`
+	URL      string      `json:"url"`
+	HTML     string      `json:"html"`
+	Base64   bool        `json:"base64"`
+	Bundle   bool        `json:"bundle"`
+	Template string      `json:"template"`
+	Data     interface{} `json:"data"`
+}
+
+type output struct {
+	Filename    string            `json:"filename"`
+	Metadata    map[string]string `json:"metadata"`
+	Destination string            `json:"destination"`
+	KeyTemplate string            `json:"key_template"`
+	URLTTL      int               `json:"url_ttl"`
 }
 
 type renderRequest interface {
-	save(riq string, clt *Client) (ConversionJob, error)
-	sourceURL() (*url.URL, error)
-	fulfill(clt *Client, cj *ConversionJob, outputDir string) ([]byte, string, error)
+	save(riq string, origin jobOrigin, clt *Client) (ConversionJob, error)
+	validate() error
+	sourceURLs() ([]*url.URL, error)
+	sourceOptions() *source
+	inputSources() []*source
+	outputOptions() *output
+	callbackURL() string
+	timeout() int
+	labels() map[string]string
+	fulfill(ctx context.Context, clt *Client, cj *ConversionJob, outputDir string) ([]byte, string, error)
 }
 
 type errorResponse struct {
-	Identifier string `json:"uuid"`
-	Message    string `json:"message"`
+	Identifier string       `json:"uuid"`
+	Message    string       `json:"message"`
+	Errors     []fieldError `json:"errors,omitempty"`
 }
 
 type renderResponse struct {
-	Identifier string   `json:"uuid"`
-	CreatedAt  string   `json:"created_at"`
-	StartedAt  string   `json:"started_at"`
-	EndedAt    string   `json:"ended_at"`
-	ExpiresIn  int      `json:"expires_in"`
-	FileURL    string   `json:"file_url"`
-	Status     string   `json:"status"`
-	Logs       []string `json:"logs"`
+	Identifier       string   `json:"uuid"`
+	CreatedAt        string   `json:"created_at"`
+	StartedAt        string   `json:"started_at"`
+	EndedAt          string   `json:"ended_at"`
+	ExpiresIn        int      `json:"expires_in"`
+	FileURL          string   `json:"file_url"`
+	FileURLExpiresAt string   `json:"file_url_expires_at"`
+	Status           string   `json:"status"`
+	Logs             []string `json:"logs"`
+
+	Client   string            `json:"client,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Batch    string            `json:"batch,omitempty"`
+	Error    *jobError         `json:"error,omitempty"`
+	Callback *callbackResponse `json:"callback,omitempty"`
+}
+
+func (s *source) html() ([]byte, error) {
+	if !s.Base64 {
+		return []byte(s.HTML), nil
+	}
+
+	html, err := base64.StdEncoding.DecodeString(s.HTML)
+	if err != nil {
+		return html, fmt.Errorf("source html is not valid base64")
+	}
+
+	return html, nil
+}
+
+func (s *source) validate() error {
+	kinds := 0
+	for _, set := range []bool{s.URL != "", s.HTML != "", s.Bundle, s.Template != ""} {
+		if set {
+			kinds++
+		}
+	}
+
+	if kinds == 0 {
+		return fmt.Errorf("source requires either a url, html, a template or a bundle")
+	}
+
+	if kinds > 1 {
+		return fmt.Errorf("source can only have one of a url, html, a template or a bundle")
+	}
+
+	if s.Data != nil && s.Template == "" {
+		return fmt.Errorf("source data can only be set along with a template")
+	}
+
+	if s.Template != "" {
+		return validateTemplateName(s.Template)
+	}
+
+	if s.HTML == "" {
+		return nil
+	}
+
+	html, err := s.html()
+	if err != nil {
+		return err
+	}
+
+	maxHTMLSize := viper.GetInt("server.max_html_size")
+	if len(html) > maxHTMLSize {
+		return fmt.Errorf("source html is %d bytes, yet the maximum is %d bytes", len(html), maxHTMLSize)
+	}
+
+	return nil
+}
+
+// isSet returns whether any kind of source is set
+func (s *source) isSet() bool {
+	return s.URL != "" || s.HTML != "" || s.Bundle || s.Template != ""
+}
+
+// input returns what to pass to wkhtmltox as the input of the conversion i.e.
+// the URL, or the path to the HTML (inline or rendered from a template) written
+// to the working directory as name, along with any flags the input needs
+func (s *source) input(c *Client, cj *ConversionJob, workDir string, name string) (string, []string, error) {
+	var flags []string
+
+	if s.Bundle {
+		data, err := c.fetchBundle(cj.Identifier)
+		if err != nil {
+			return "", flags, fmt.Errorf("unable to fetch bundle, it may have expired")
+		}
+
+		dir := filepath.Join(workDir, bundleDir)
+		err = extractBundle(data, dir)
+		if err != nil {
+			return "", flags, err
+		}
+
+		// Local file access is disabled for every conversion, only allow the
+		// bundle so that it can't be used to read other files on the worker
+		flags = append(flags, "--allow", dir)
+
+		return filepath.Join(dir, bundleIndexFile), flags, nil
+	}
+
+	if s.HTML == "" && s.Template == "" {
+		return s.URL, flags, nil
+	}
+
+	var (
+		html []byte
+		err  error
+	)
+	if s.Template != "" {
+		html, err = c.executeTemplate(s.Template, s.Data)
+	} else {
+		html, err = s.html()
+	}
+	if err != nil {
+		return "", flags, err
+	}
+
+	inputFile := filepath.Join(workDir, name)
+	err = ioutil.WriteFile(inputFile, html, 0600)
+	if err != nil {
+		return "", flags, err
+	}
+
+	// Inline HTML and the output of templates are rendered from a local file,
+	// only allow the working directory so that they can't be used to read
+	// other files on the worker e.g. with '<iframe src="file:///etc/passwd">'
+	flags = append(flags, "--allow", workDir)
+
+	return inputFile, flags, nil
+}
+
+func (o *output) validate() error {
+	if o.Filename != "" {
+		if o.Filename != filepath.Base(o.Filename) || strings.HasPrefix(o.Filename, ".") {
+			return fmt.Errorf("invalid output filename '%s'", o.Filename)
+		}
+	}
+
+	for k := range o.Metadata {
+		if k == "" || strings.ContainsAny(k, " :\r\n") {
+			return fmt.Errorf("invalid output metadata key '%s'", k)
+		}
+
+		if strings.HasPrefix(strings.ToLower(k), "sanaa-") {
+			return fmt.Errorf("output metadata key '%s' uses the reserved 'sanaa-' prefix", k)
+		}
+	}
+
+	if o.URLTTL != 0 {
+		maxURLTTL := viper.GetInt("server.max_url_ttl")
+		if o.URLTTL < MinURLTTL {
+			return fmt.Errorf("set url_ttl is %d, yet the minimum is %d", o.URLTTL, MinURLTTL)
+		}
+
+		if o.URLTTL > maxURLTTL {
+			return fmt.Errorf("set url_ttl is %d, yet the maximum is %d", o.URLTTL, maxURLTTL)
+		}
+	}
+
+	if o.Destination != "" {
+		err := validateStorageDestination(o.Destination)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Render the key template with sample data to catch errors before the job
+	// is enqueued
+	sample := newStorageKeyData(&ConversionJob{Identifier: uuid.Nil.String()}, "file.ext")
+	_, prefix := splitStorageDestination(o.Destination)
+	_, err := generateStorageKey(o.KeyTemplate, prefix, sample)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
 func requestBadRequestResponse(w *http.ResponseWriter, r *http.Request, ers errorResponse) {
@@ -96,6 +307,40 @@ func requestInternalServerErrorResponse(w *http.ResponseWriter, r *http.Request,
 	}).Errorf("%d %s", http.StatusInternalServerError, "Internal Server Error")
 }
 
+func requestForbiddenResponse(w *http.ResponseWriter, r *http.Request, ers errorResponse) {
+	log.WithFields(log.Fields{
+		"uuid": ers.Identifier,
+	}).Error(ers.Message)
+
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusForbidden)
+
+	encoder := json.NewEncoder((*w))
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(&ers)
+
+	log.WithFields(log.Fields{
+		"uuid": ers.Identifier,
+	}).Errorf("%d %s", http.StatusForbidden, "Forbidden")
+}
+
+func requestConflictResponse(w *http.ResponseWriter, r *http.Request, ers errorResponse) {
+	log.WithFields(log.Fields{
+		"uuid": ers.Identifier,
+	}).Error(ers.Message)
+
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(http.StatusConflict)
+
+	encoder := json.NewEncoder((*w))
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(&ers)
+
+	log.WithFields(log.Fields{
+		"uuid": ers.Identifier,
+	}).Errorf("%d %s", http.StatusConflict, "Conflict")
+}
+
 func requestNotFoundResponse(w *http.ResponseWriter, r *http.Request, ers errorResponse) {
 	log.WithFields(log.Fields{
 		"uuid": ers.Identifier,
@@ -126,6 +371,20 @@ func requestCreatedResponse(w *http.ResponseWriter, r *http.Request, rrs renderR
 	}).Debugf("%d %s", http.StatusCreated, "Created")
 }
 
+func requestAcceptedResponse(w *http.ResponseWriter, r *http.Request, rrs renderResponse) {
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).Header().Set("Location", fmt.Sprintf("/status/%s", rrs.Identifier))
+	(*w).WriteHeader(http.StatusAccepted)
+
+	encoder := json.NewEncoder((*w))
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(&rrs)
+
+	log.WithFields(log.Fields{
+		"uuid": rrs.Identifier,
+	}).Debugf("%d %s", http.StatusAccepted, "Accepted")
+}
+
 func requestOKResponse(w *http.ResponseWriter, r *http.Request, rrs renderResponse) {
 	(*w).Header().Set("Content-Type", "application/json")
 	(*w).WriteHeader(http.StatusOK)
@@ -139,22 +398,37 @@ func requestOKResponse(w *http.ResponseWriter, r *http.Request, rrs renderRespon
 	}).Debugf("%d %s", http.StatusOK, "OK")
 }
 
+func requestJSONResponse(w *http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	(*w).Header().Set("Content-Type", "application/json")
+	(*w).WriteHeader(status)
+
+	encoder := json.NewEncoder((*w))
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(body)
+
+	log.Debugf("%d %s", status, http.StatusText(status))
+}
+
+func newRenderRequest(target string) renderRequest {
+	switch target {
+	case "image":
+		return &imageRenderRequest{}
+	case "pdf":
+		return &pdfRenderRequest{}
+	}
+
+	return nil
+}
+
 func (clt *Client) renderHandler(w http.ResponseWriter, r *http.Request) {
-	var (
-		ers errorResponse
-		rrq renderRequest
-	)
+	var ers errorResponse
 
 	params := mux.Vars(r)
 	target := params["target"]
 	rid := uuid.NewV4().String()
 
-	switch target {
-	case "image":
-		rrq = &imageRenderRequest{}
-	case "pdf":
-		rrq = &pdfRenderRequest{}
-	default:
+	rrq := newRenderRequest(target)
+	if rrq == nil {
 		ers = errorResponse{
 			Identifier: rid,
 			Message:    fmt.Sprintf("invalid %s render request", target),
@@ -164,18 +438,194 @@ func (clt *Client) renderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := json.NewDecoder(r.Body).Decode(rrq)
+	wait, err := parseRenderWait(r)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	maxRequestSize := viper.GetInt64("server.max_request_size")
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    fmt.Sprintf("unable to read request body of at most %d bytes: %v", maxRequestSize, err),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	clt.submitRenderRequest(w, r, rid, target, rrq, body, nil, wait)
+}
+
+// submitRenderRequest decodes the render request from data, validates and
+// checks it, saves its job and responds with it. It's shared by render
+// requests with and without a bundle, data is nil if a bundle is uploaded
+// without a request and bundle is nil if there's no bundle
+func (clt *Client) submitRenderRequest(w http.ResponseWriter, r *http.Request, rid string, target string, rrq renderRequest, data []byte, bundle []byte, wait time.Duration) {
+	var ers errorResponse
+
+	if data != nil {
+		err := validateTarget(target, data)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: rid,
+				Message:    err.Error(),
+			}
+			if verr, ok := err.(*validationError); ok {
+				ers.Errors = verr.fields
+			}
+			requestBadRequestResponse(&w, r, ers)
+
+			return
+		}
+
+		err = json.Unmarshal(data, rrq)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: rid,
+				Message:    fmt.Sprintf("unable to unmarshal json to %s type", target),
+			}
+			requestBadRequestResponse(&w, r, ers)
+
+			return
+		}
+	}
+
+	if bundle != nil {
+		rrq.sourceOptions().Bundle = true
+	} else if rrq.sourceOptions().Bundle {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    "bundles have to be uploaded as multipart/form-data or application/zip",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	err := rrq.validate()
 	if err != nil {
 		ers = errorResponse{
 			Identifier: rid,
-			Message:    fmt.Sprintf("unable to unmarshal json to %s type", target),
+			Message:    err.Error(),
+		}
+		if verr, ok := err.(*validationError); ok {
+			ers.Errors = verr.fields
 		}
 		requestBadRequestResponse(&w, r, ers)
 
 		return
 	}
 
-	cj, err := rrq.save(rid, clt)
+	client, err := parseClient(r)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	// Check the URLs of the sources before the job is enqueued, they're checked
+	// again by the worker since what hosts resolve to may change
+	err = clt.checkSources(rrq)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		if perr, ok := err.(*sourcePolicyError); ok && perr.denied {
+			requestForbiddenResponse(&w, r, ers)
+		} else {
+			requestBadRequestResponse(&w, r, ers)
+		}
+
+		return
+	}
+
+	err = clt.checkCallback(rrq.callbackURL())
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		if perr, ok := err.(*sourcePolicyError); ok && perr.denied {
+			requestForbiddenResponse(&w, r, ers)
+		} else {
+			requestBadRequestResponse(&w, r, ers)
+		}
+
+		return
+	}
+
+	// Catch requests for templates that don't exist before the job is enqueued,
+	// the template is only executed by the worker
+	for _, src := range rrq.inputSources() {
+		name := src.Template
+		if name == "" {
+			continue
+		}
+
+		_, found, err := clt.fetchTemplate(name)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: rid,
+				Message:    "unable to fetch template",
+			}
+			requestInternalServerErrorResponse(&w, r, ers)
+
+			return
+		}
+
+		if !found {
+			ers = errorResponse{
+				Identifier: rid,
+				Message:    fmt.Sprintf("template '%s' not found", name),
+			}
+			requestBadRequestResponse(&w, r, ers)
+
+			return
+		}
+	}
+
+	if bundle != nil {
+		err = validateBundle(bundle)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: rid,
+				Message:    err.Error(),
+			}
+			requestBadRequestResponse(&w, r, ers)
+
+			return
+		}
+
+		// The bundle has to be saved before the job is enqueued so that it's
+		// there when a worker picks up the job
+		err = clt.saveBundle(rid, bundle)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: rid,
+				Message:    "unable to save bundle",
+			}
+			requestInternalServerErrorResponse(&w, r, ers)
+
+			return
+		}
+	}
+
+	cj, err := rrq.save(rid, jobOrigin{client: client}, clt)
 	if err != nil {
 		ers = errorResponse{
 			Identifier: rid,
@@ -185,9 +635,19 @@ func (clt *Client) renderHandler(w http.ResponseWriter, r *http.Request) {
 
 		return
 	}
+	msg := "enqueued render %s job"
+	if bundle != nil {
+		msg = "enqueued render %s job with bundle"
+	}
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
-	}).Infof("enqueued render %s job", target)
+	}).Infof(msg, target)
+
+	if wait > 0 {
+		clt.respondWhenFinished(w, r, &cj, wait)
+
+		return
+	}
 
 	rrs, err := cj.generateRenderResponse(clt)
 	if err != nil {
@@ -220,9 +680,7 @@ func (clt *Client) statusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn := clt.redisPool.Get()
-	defer conn.Close()
-
+	// Don't hold on to a connection from the pool, the request may long-poll
 	cj, found, err := clt.fetchConversionJob(jid)
 	if err != nil {
 		ers = errorResponse{
@@ -244,6 +702,34 @@ func (clt *Client) statusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Long-poll i.e. hold on to the request until the status of the job
+	// changes, or the wait is up
+	if value := r.URL.Query().Get("wait"); value != "" {
+		wait, err := parseWait(value)
+		if err != nil {
+			ers = errorResponse{
+				Identifier: jid,
+				Message:    err.Error(),
+			}
+			requestBadRequestResponse(&w, r, ers)
+
+			return
+		}
+
+		if wait > maxWait() {
+			wait = maxWait()
+		}
+
+		wcj, _, err := clt.waitForConversionJobChange(jid, cj.Status, wait, r.Context().Done())
+		if err != nil {
+			log.WithFields(log.Fields{
+				"uuid": jid,
+			}).Errorf("error waiting for conversion job: %v", err)
+		} else if wcj.Identifier != "" {
+			cj = wcj
+		}
+	}
+
 	rrs, err := cj.generateRenderResponse(clt)
 	if err != nil {
 		ers = errorResponse{
@@ -262,7 +748,99 @@ func (clt *Client) statusHandler(w http.ResponseWriter, r *http.Request) {
 	requestOKResponse(&w, r, rrs)
 }
 
-func (cj *ConversionJob) generateRenderResponse(clt *Client) (renderResponse, error) {
+func (clt *Client) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	jid := params["uuid"]
+
+	_, err := uuid.FromString(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "invalid job identifier",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	cj, found, err := clt.fetchConversionJob(jid)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to fetch conversion job",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !found {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "request not found on conversion queue",
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	if cj.Status != "succeeded" {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    fmt.Sprintf("conversion job is %s, the rendered file is not available", cj.Status),
+		}
+		requestConflictResponse(&w, r, ers)
+
+		return
+	}
+
+	clt.serveRenderedFile(w, r, &cj)
+}
+
+// serveRenderedFile streams the rendered file of a succeeded conversion job
+func (clt *Client) serveRenderedFile(w http.ResponseWriter, r *http.Request, cj *ConversionJob) {
+	var ers errorResponse
+
+	jid := cj.Identifier
+	reader, obj, err := clt.storage.Open(cj)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: jid,
+			Message:    "unable to open rendered file",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+	defer reader.Close()
+
+	_, key, _ := parseStorageLocation(viper.GetString("storage.backend"), cj.StorageLocation)
+	name := path.Base(key)
+
+	// Setting the ETag lets ServeContent handle If-None-Match and If-Range,
+	// it handles Range requests too since the reader can seek
+	if obj.ContentType != "" {
+		w.Header().Set("Content-Type", obj.ContentType)
+	}
+	if obj.ContentDisposition != "" {
+		w.Header().Set("Content-Disposition", obj.ContentDisposition)
+	}
+	if obj.ETag != "" {
+		w.Header().Set("ETag", obj.ETag)
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": jid,
+	}).Info("streaming rendered file")
+
+	http.ServeContent(w, r, name, obj.LastModified, reader)
+}
+
+// summarizeRenderResponse generates the render response of the conversion job
+// without the URL to the rendered file
+func (cj *ConversionJob) summarizeRenderResponse() renderResponse {
 	rrs := renderResponse{
 		Identifier: cj.Identifier,
 		CreatedAt:  cj.CreatedAt,
@@ -270,6 +848,11 @@ func (cj *ConversionJob) generateRenderResponse(clt *Client) (renderResponse, er
 		EndedAt:    cj.EndedAt,
 		ExpiresIn:  cj.ExpiresIn,
 		Status:     cj.Status,
+		Client:     cj.Client,
+		Labels:     cj.labels(),
+		Batch:      cj.Batch,
+		Error:      cj.jobError(),
+		Callback:   cj.generateCallbackResponse(),
 	}
 
 	logs := string(cj.Logs)
@@ -281,6 +864,12 @@ func (cj *ConversionJob) generateRenderResponse(clt *Client) (renderResponse, er
 		rrs.Logs[i] = strings.TrimSpace(entry)
 	}
 
+	return rrs
+}
+
+func (cj *ConversionJob) generateRenderResponse(clt *Client) (renderResponse, error) {
+	rrs := cj.summarizeRenderResponse()
+
 	if cj.Status != "succeeded" {
 
 		return rrs, nil
@@ -290,8 +879,23 @@ func (cj *ConversionJob) generateRenderResponse(clt *Client) (renderResponse, er
 		"uuid": cj.Identifier,
 	}).Debugln("conversion job found completed")
 
-	timeToExpire := 5 * time.Minute
-	surl, err := clt.getFileS3SignedURL(cj, timeToExpire)
+	rR, err := cj.renderRequest()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Error(err)
+
+		return rrs, err
+	}
+
+	urlTTL := viper.GetInt("server.url_ttl")
+	if rR.outputOptions().URLTTL != 0 {
+		urlTTL = rR.outputOptions().URLTTL
+	}
+
+	timeToExpire := time.Duration(urlTTL) * time.Second
+	expiresAt := time.Now().UTC().Add(timeToExpire)
+	surl, err := clt.storage.Locate(cj, timeToExpire)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"uuid": cj.Identifier,
@@ -300,6 +904,7 @@ func (cj *ConversionJob) generateRenderResponse(clt *Client) (renderResponse, er
 		return rrs, err
 	}
 	rrs.FileURL = surl
+	rrs.FileURLExpiresAt = expiresAt.Format(time.RFC3339)
 
 	return rrs, nil
 }
@@ -309,6 +914,39 @@ func (clt *Client) StartServer() {
 	requestTTL := viper.GetInt("server.request_ttl")
 	log.Infof("request TTL set to %d seconds", requestTTL)
 
+	urlTTL := viper.GetInt("server.url_ttl")
+	maxURLTTL := viper.GetInt("server.max_url_ttl")
+	log.Infof("file URL TTL set to %d seconds, maximum is %d seconds", urlTTL, maxURLTTL)
+
+	maxHTMLSize := viper.GetInt("server.max_html_size")
+	log.Infof("maximum size of inline HTML sources set to %d bytes", maxHTMLSize)
+
+	maxBundleSize := viper.GetInt("server.max_bundle_size")
+	log.Infof("maximum size of uploaded bundles set to %d bytes", maxBundleSize)
+
+	maxRequestSize := viper.GetInt("server.max_request_size")
+	log.Infof("maximum size of render requests set to %d bytes", maxRequestSize)
+
+	maxWait := viper.GetInt("server.max_wait")
+	log.Infof("maximum wait of render requests set to %d seconds", maxWait)
+
+	maxBatchSize := viper.GetInt("server.max_batch_size")
+	log.Infof("maximum number of render requests in a batch set to %d", maxBatchSize)
+
+	defaultTimeout := viper.GetInt("server.conversion_timeout")
+	maxConversionTimeout := viper.GetInt("server.max_conversion_timeout")
+	log.Infof("conversion timeout set to %d seconds, maximum is %d seconds", defaultTimeout, maxConversionTimeout)
+
+	callbackMaxAttempts := viper.GetInt("server.callback_max_attempts")
+	callbackTimeout := viper.GetInt("server.callback_timeout")
+	log.Infof("callbacks attempted up to %d times, waiting %d seconds for a response", callbackMaxAttempts, callbackTimeout)
+	if viper.GetString("server.callback_secret") == "" {
+		log.Warn("callback secret not set, callbacks won't be signed")
+	}
+
+	storage := viper.GetString("storage.backend")
+	log.Infof("locating rendered files using the %s backend", storage)
+
 	health := healthcheck.NewHandler()
 
 	redisAddress := viper.GetString("redis.host")
@@ -325,14 +963,52 @@ func (clt *Client) StartServer() {
 	router.HandleFunc("/render/{target}", clt.renderHandler).
 		Headers("Content-Type", "application/json").
 		Methods("POST")
+	router.HandleFunc("/render/{target}", clt.renderBundleHandler).
+		HeadersRegexp("Content-Type", "^multipart/form-data").
+		Methods("POST")
+	router.HandleFunc("/render/{target}", clt.renderBundleHandler).
+		Headers("Content-Type", "application/zip").
+		Methods("POST")
 	router.HandleFunc("/status/{uuid}", clt.statusHandler).
 		Headers("Content-Type", "application/json").
 		Methods("GET")
+	router.HandleFunc("/download/{uuid}", clt.downloadHandler).
+		Methods("GET")
+	router.HandleFunc("/events/{uuid}", clt.eventsHandler).
+		Methods("GET")
+	router.HandleFunc("/batches", clt.batchHandler).
+		Headers("Content-Type", "application/json").
+		Methods("POST")
+	router.HandleFunc("/batches/{uuid}", clt.batchStatusHandler).
+		Methods("GET")
+	router.HandleFunc("/jobs", clt.listJobsHandler).
+		Methods("GET")
+	router.HandleFunc("/jobs/{uuid}", clt.cancelHandler).
+		Methods("DELETE")
+	router.HandleFunc("/templates", clt.listTemplatesHandler).
+		Methods("GET")
+	router.HandleFunc("/templates/{name}", clt.putTemplateHandler).
+		Headers("Content-Type", "application/json").
+		Methods("PUT")
+	router.HandleFunc("/templates/{name}", clt.getTemplateHandler).
+		Methods("GET")
+	router.HandleFunc("/templates/{name}", clt.deleteTemplateHandler).
+		Methods("DELETE")
+
+	if storage == FilesystemStorage {
+		router.HandleFunc("/files/{uuid}/{name}", clt.filesHandler).
+			Methods("GET")
+	}
 
 	bindingAddress := viper.GetString("server.binding_address")
 	bindingPort := viper.GetInt("server.binding_port")
 	binding := fmt.Sprintf("%s:%d", bindingAddress, bindingPort)
 
+	// Deliver callbacks of finished jobs from the server since it's what
+	// generates the render responses that are sent
+	dispatcher := clt.startCallbackDispatcher()
+	defer dispatcher.Stop()
+
 	log.Infof("listening on http://%s", binding)
 	http.Handle("/", router)
 	http.ListenAndServe(binding, nil)
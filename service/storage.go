@@ -17,94 +17,256 @@ package service
 
 import (
 	"bytes"
-	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 
-	"io/ioutil"
+	"github.com/spf13/viper"
+)
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/service/s3"
+const (
+	// S3Storage is the name of the storage backend that keeps rendered files in
+	// an S3 bucket
+	S3Storage = "s3"
 
-	log "github.com/sirupsen/logrus"
+	// FilesystemStorage is the name of the storage backend that keeps rendered
+	// files in a directory shared by the server and the worker
+	FilesystemStorage = "filesystem"
 )
 
-func (cl *Client) storeFileS3(cj *ConversionJob, filePath string) error {
-	svc := s3.New(cl.awsSession)
+// StorageBackends is a list of the names of all supported storage backends
+var StorageBackends = []string{S3Storage, FilesystemStorage}
+
+// defaultStorageKeyTemplate is the template of the key rendered files are
+// stored under if a render request doesn't set one
+const defaultStorageKeyTemplate = "{{.UUID}}/{{.Filename}}"
+
+// contentTypes maps the extensions of rendered files to their MIME type
+var contentTypes = map[string]string{
+	"bmp":  "image/bmp",
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"pdf":  "application/pdf",
+	"png":  "image/png",
+	"svg":  "image/svg+xml",
+	"zip":  "application/zip",
+}
+
+// Storage is implemented by the backends that keep rendered files
+type Storage interface {
+	// Put stores the file found at filePath under the given key in the given
+	// container (or the default container if empty), with the content type,
+	// content disposition and metadata of the object passed in, and returns the
+	// location of the stored file
+	Put(cj *ConversionJob, container string, key string, filePath string, obj StorageObject) (string, error)
+
+	// Locate returns a URL that can be used to fetch the stored file of the
+	// job, valid for the duration passed in
+	Locate(cj *ConversionJob, exp time.Duration) (string, error)
+
+	// Delete removes the stored file of the job
+	Delete(cj *ConversionJob) error
+
+	// Stat returns details of the stored file of the job
+	Stat(cj *ConversionJob) (StorageObject, error)
 
-	// Create a context with a timeout that will abort the upload if it takes more
-	// than the passed in timeout
-	timeout := 60 * time.Second
-	ctx := context.Background()
-	ctx, cancelFn := context.WithTimeout(ctx, timeout)
+	// Open returns a reader of the stored file of the job along with its
+	// details, the reader has to be closed once done
+	Open(cj *ConversionJob) (StorageReader, StorageObject, error)
+}
+
+// StorageReader reads a stored file, seeking allows serving parts of it
+type StorageReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// StorageObject describes a file kept by a storage backend
+type StorageObject struct {
+	Size               int64
+	ContentType        string
+	ContentDisposition string
+	ETag               string
+	LastModified       time.Time
+	Metadata           map[string]string
+}
 
-	// Ensure the context is canceled to prevent leaking. See context package for
-	// more information, https://golang.org/pkg/context/
-	defer cancelFn()
+func newStorage(backend string) (Storage, error) {
+	switch backend {
+	case S3Storage:
+		return newS3Storage()
+	case FilesystemStorage:
+		return newFilesystemStorage(), nil
+	default:
+		return nil, fmt.Errorf("unsupported storage backend '%s'", backend)
+	}
+}
 
-	log.WithFields(log.Fields{
-		"uuid": cj.Identifier,
-	}).Debug("read file from working directory")
-	data, err := ioutil.ReadFile(filePath)
+func generateStorageFilename(out *output, filePath string) string {
+	if out.Filename == "" {
+		return filepath.Base(filePath)
+	}
+
+	// Make sure the file keeps the extension of the format it was rendered to
+	if filepath.Ext(out.Filename) == "" {
+		return out.Filename + filepath.Ext(filePath)
+	}
+
+	return out.Filename
+}
+
+func generateStorageObject(cj *ConversionJob, out *output, filePath string, name string) StorageObject {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filePath), "."))
+	contentType, ok := contentTypes[ext]
+	if !ok {
+		contentType = "application/octet-stream"
+	}
+
+	disposition := mime.FormatMediaType("inline", map[string]string{"filename": name})
+	if disposition == "" {
+		disposition = "inline"
+	}
+
+	// User supplied metadata can't override the metadata that we use to trace
+	// stored files back to their jobs
+	metadata := map[string]string{}
+	for k, v := range out.Metadata {
+		metadata[k] = v
+	}
+	version := GetVersion()
+	metadata["sanaa-uuid"] = cj.Identifier
+	metadata["sanaa-request-type"] = cj.RequestType
+	metadata["sanaa-version"] = version.Str()
+
+	return StorageObject{
+		ContentType:        contentType,
+		ContentDisposition: disposition,
+		Metadata:           metadata,
+	}
+}
+
+// storageKeyData is the data available to storage key templates
+type storageKeyData struct {
+	UUID      string
+	Date      string
+	Year      string
+	Month     string
+	Day       string
+	Filename  string
+	Extension string
+}
+
+func newStorageKeyData(cj *ConversionJob, name string) storageKeyData {
+	createdAt, err := time.Parse(time.RFC3339, cj.CreatedAt)
 	if err != nil {
-		return err
+		createdAt = time.Now().UTC()
+	}
+
+	return storageKeyData{
+		UUID:      cj.Identifier,
+		Date:      createdAt.Format("2006-01-02"),
+		Year:      createdAt.Format("2006"),
+		Month:     createdAt.Format("01"),
+		Day:       createdAt.Format("02"),
+		Filename:  name,
+		Extension: strings.TrimPrefix(filepath.Ext(name), "."),
 	}
+}
 
-	log.WithFields(log.Fields{
-		"uuid": cj.Identifier,
-	}).Info("start upload of file to S3")
+func generateStorageKey(tmpl string, prefix string, data storageKeyData) (string, error) {
+	if tmpl == "" {
+		tmpl = defaultStorageKeyTemplate
+	}
 
-	// Uploads the object to S3 ... the Context will interrupt the request if the
-	// timeout expires
-	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(cj.StorageBucket),
-		Key:    aws.String(cj.StorageKey),
-		Body:   bytes.NewReader(data),
-	})
+	t, err := template.New("key").Parse(tmpl)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.CanceledErrorCode {
-			// If the SDK can determine the request or retry delay was canceled
-			// by a context the CanceledErrorCode error code will be returned
-			log.WithFields(log.Fields{
-				"uuid": cj.Identifier,
-			}).Errorf("upload cancelled due to timeout: %v", err)
-		} else {
-			log.WithFields(log.Fields{
-				"uuid": cj.Identifier,
-			}).Errorf("failed to upload file: %v", err)
-		}
+		return "", err
+	}
 
-		return err
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
 	}
 
-	log.WithFields(log.Fields{
-		"uuid": cj.Identifier,
-	}).Info("completed upload of file to S3")
+	// Keys are always relative to the prefix, they can't climb out of it
+	rel := strings.TrimPrefix(path.Clean("/"+buf.String()), "/")
+	if rel == "" || strings.HasSuffix(buf.String(), "/") {
+		return "", fmt.Errorf("storage key template '%s' renders to an invalid key '%s'", tmpl, buf.String())
+	}
+
+	// Keys have to be unique to the job so that it can't overwrite the files
+	// of other jobs, nor have its file deleted when another job expires
+	if !strings.Contains(rel, data.UUID) {
+		return "", fmt.Errorf("storage key template '%s' has to include {{.UUID}}", tmpl)
+	}
+
+	key := strings.TrimPrefix(path.Clean("/"+path.Join(prefix, rel)), "/")
+
+	return key, nil
+}
+
+func splitStorageDestination(dest string) (string, string) {
+	parts := strings.SplitN(strings.Trim(dest, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
 
-	return nil
+	return parts[0], parts[1]
 }
 
-func (cl *Client) getFileS3SignedURL(cj *ConversionJob, exp time.Duration) (string, error) {
-	svc := s3.New(cl.awsSession)
+func validateStorageDestination(dest string) error {
+	container, prefix := splitStorageDestination(dest)
+
+	// Prefixes are compared as is, so they can't have segments that would
+	// point elsewhere once cleaned e.g. 'allowed/../other'
+	if prefix != "" && path.Clean("/"+prefix) != "/"+prefix {
+		return fmt.Errorf("storage destination '%s' is not a clean path", dest)
+	}
+
+	for _, allowed := range viper.GetStringSlice("server.allowed_destinations") {
+		ac, ap := splitStorageDestination(allowed)
+		if container != ac {
+			continue
+		}
 
-	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: &cj.StorageBucket,
-		Key:    &cj.StorageKey,
-	})
+		if ap == "" || prefix == ap || strings.HasPrefix(prefix, ap+"/") {
+			return nil
+		}
+	}
 
-	log.WithFields(log.Fields{
-		"uuid": cj.Identifier,
-	}).Debugln("generating pre-signed url to rendered file")
+	return fmt.Errorf("storage destination '%s' is not allowed", dest)
+}
 
-	url, err := req.Presign(exp)
+func generateStorageLocation(backend string, container string, key string) string {
+	loc := url.URL{
+		Scheme: backend,
+		Host:   container,
+		Path:   "/" + key,
+	}
+
+	return loc.String()
+}
+
+func parseStorageLocation(backend string, location string) (string, string, error) {
+	loc, err := url.Parse(location)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Error("failed to pre-sign url")
+		return "", "", err
+	}
+
+	if loc.Scheme != backend {
+		return "", "", fmt.Errorf("storage location '%s' does not belong to the %s backend", location, backend)
+	}
 
-		return url, err
+	if loc.Path == "" || loc.Path == "/" {
+		return "", "", fmt.Errorf("incomplete storage location '%s'", location)
 	}
 
-	return url, nil
+	return loc.Host, strings.TrimPrefix(loc.Path, "/"), nil
 }
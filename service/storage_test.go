@@ -0,0 +1,111 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestGenerateStorageKey(t *testing.T) {
+	jid := "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+	data := newStorageKeyData(&ConversionJob{
+		Identifier: jid,
+		CreatedAt:  "2018-01-02T15:04:05Z",
+	}, "file.pdf")
+
+	tests := []struct {
+		name   string
+		tmpl   string
+		prefix string
+		key    string
+		err    bool
+	}{
+		{name: "default template", key: jid + "/file.pdf"},
+		{name: "default template with prefix", prefix: "invoices", key: "invoices/" + jid + "/file.pdf"},
+		{name: "custom template", tmpl: "{{.Year}}/{{.Month}}/{{.Day}}/{{.UUID}}.{{.Extension}}", key: "2018/01/02/" + jid + ".pdf"},
+		{name: "date and filename", tmpl: "{{.Date}}/{{.UUID}}-{{.Filename}}", prefix: "a/b", key: "a/b/2018-01-02/" + jid + "-file.pdf"},
+		{name: "absolute key stays under prefix", tmpl: "/{{.UUID}}.pdf", prefix: "invoices", key: "invoices/" + jid + ".pdf"},
+		{name: "parent segments stay under prefix", tmpl: "../../{{.UUID}}/x.pdf", prefix: "invoices", key: "invoices/" + jid + "/x.pdf"},
+		{name: "parent segments stay under root", tmpl: "../{{.UUID}}/x.pdf", key: jid + "/x.pdf"},
+		{name: "backslashes aren't separators", tmpl: `..\{{.UUID}}.pdf`, prefix: "invoices", key: `invoices/..\` + jid + ".pdf"},
+		{name: "redundant separators", tmpl: "x//./{{.UUID}}.pdf", key: "x/" + jid + ".pdf"},
+		{name: "missing uuid", tmpl: "invoices/{{.Filename}}", err: true},
+		{name: "uuid of another job", tmpl: "0b4e28ba-2fa1-11d2-883f-0016d3cca427/{{.Filename}}", err: true},
+		{name: "uuid cleaned away", tmpl: "{{.UUID}}/../{{.Filename}}", err: true},
+		{name: "trailing separator", tmpl: "{{.UUID}}/", err: true},
+		{name: "empty key", tmpl: "/", err: true},
+		{name: "unknown field", tmpl: "{{.Bucket}}/{{.UUID}}", err: true},
+		{name: "malformed template", tmpl: "{{.UUID}", err: true},
+	}
+
+	for _, tt := range tests {
+		key, err := generateStorageKey(tt.tmpl, tt.prefix, data)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got key '%s'", tt.name, key)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+
+			continue
+		}
+
+		if key != tt.key {
+			t.Errorf("%s: expected key '%s', got '%s'", tt.name, tt.key, key)
+		}
+	}
+}
+
+func TestValidateStorageDestination(t *testing.T) {
+	viper.Set("server.allowed_destinations", []string{"reports", "shared/tenants/acme"})
+	defer viper.Set("server.allowed_destinations", nil)
+
+	tests := []struct {
+		dest    string
+		allowed bool
+	}{
+		{dest: "reports", allowed: true},
+		{dest: "reports/2018", allowed: true},
+		{dest: "/reports/2018/", allowed: true},
+		{dest: "shared/tenants/acme", allowed: true},
+		{dest: "shared/tenants/acme/invoices", allowed: true},
+		{dest: "shared", allowed: false},
+		{dest: "shared/tenants", allowed: false},
+		{dest: "shared/tenants/acme-evil", allowed: false},
+		{dest: "shared/tenants/acme/../other", allowed: false},
+		{dest: "shared/tenants/acme/./x", allowed: false},
+		{dest: "shared/tenants/acme//x", allowed: false},
+		{dest: "reports/..", allowed: false},
+		{dest: "other", allowed: false},
+	}
+
+	for _, tt := range tests {
+		err := validateStorageDestination(tt.dest)
+		if tt.allowed && err != nil {
+			t.Errorf("%s: expected to be allowed, got: %v", tt.dest, err)
+		}
+
+		if !tt.allowed && err == nil {
+			t.Errorf("%s: expected not to be allowed", tt.dest)
+		}
+	}
+}
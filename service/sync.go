@@ -0,0 +1,152 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MinMaxWait is the minimum that the maximum time render requests can wait for
+// their job to finish can be set to, in seconds
+const MinMaxWait = 1
+
+// maxWait returns the maximum time requests can wait for
+func maxWait() time.Duration {
+	return time.Duration(viper.GetInt("server.max_wait")) * time.Second
+}
+
+// parseWait parses how long to wait for either as a duration e.g. '30s' or a
+// number of seconds e.g. '30'
+func parseWait(value string) (time.Duration, error) {
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return wait, fmt.Errorf("invalid wait '%s', set a duration e.g. 30s", value)
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait <= 0 {
+		return wait, fmt.Errorf("invalid wait '%s', it has to be positive", value)
+	}
+
+	return wait, nil
+}
+
+// parseRenderWait returns how long a render request should wait for its job to
+// finish, set via the 'wait' query parameter or the 'Prefer: wait' header. It's
+// capped by the maximum wait, and zero means the request shouldn't wait
+func parseRenderWait(r *http.Request) (time.Duration, error) {
+	var (
+		wait time.Duration
+		err  error
+	)
+
+	if value := r.URL.Query().Get("wait"); value != "" {
+		wait, err = parseWait(value)
+		if err != nil {
+			return wait, err
+		}
+	} else {
+		for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+			pref = strings.TrimSpace(strings.ToLower(pref))
+			if pref == "wait" {
+				wait = maxWait()
+
+				continue
+			}
+
+			if strings.HasPrefix(pref, "wait=") {
+				wait, err = parseWait(strings.TrimPrefix(pref, "wait="))
+				if err != nil {
+					return wait, err
+				}
+			}
+		}
+	}
+
+	if wait > maxWait() {
+		wait = maxWait()
+	}
+
+	return wait, nil
+}
+
+// acceptsJSON returns whether the client asked for JSON rather than the file
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// respondWhenFinished waits for the conversion job to finish and responds with
+// the rendered file, or the final render response if the client asked for JSON
+// or the job failed. If it doesn't finish in time it responds with '202
+// Accepted' so that the client can check the status of the job later
+func (clt *Client) respondWhenFinished(w http.ResponseWriter, r *http.Request, cj *ConversionJob, wait time.Duration) {
+	var ers errorResponse
+
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debugf("waiting up to %s for conversion job to finish", wait)
+
+	// Let clients know that their 'Prefer: wait' was honoured, the wait query
+	// parameter takes precedence over it
+	if r.URL.Query().Get("wait") == "" {
+		w.Header().Set("Preference-Applied", "wait")
+	}
+
+	fcj, finished, err := clt.waitForConversionJob(cj.Identifier, wait, r.Context().Done())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Errorf("error waiting for conversion job: %v", err)
+		fcj = *cj
+		finished = false
+	}
+
+	if finished && fcj.Status == "succeeded" && !acceptsJSON(r) {
+		clt.serveRenderedFile(w, r, &fcj)
+
+		return
+	}
+
+	rrs, err := fcj.generateRenderResponse(clt)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: fcj.Identifier,
+			Message:    "failed to generate render response",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !finished {
+		requestAcceptedResponse(&w, r, rrs)
+
+		return
+	}
+
+	requestOKResponse(&w, r, rrs)
+}
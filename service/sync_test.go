@@ -0,0 +1,71 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseRenderWait(t *testing.T) {
+	viper.Set("server.max_wait", 60)
+	defer viper.Set("server.max_wait", nil)
+
+	tests := []struct {
+		name    string
+		query   string
+		prefer  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"no wait", "", "", 0, false},
+		{"duration", "wait=30s", "", 30 * time.Second, false},
+		{"seconds", "wait=30", "", 30 * time.Second, false},
+		{"capped", "wait=5m", "", 60 * time.Second, false},
+		{"zero", "wait=0", "", 0, true},
+		{"negative", "wait=-5s", "", 0, true},
+		{"invalid", "wait=soon", "", 0, true},
+		{"prefer", "", "wait", 60 * time.Second, false},
+		{"prefer seconds", "", "wait=10", 10 * time.Second, false},
+		{"prefer case", "", "Wait=10", 10 * time.Second, false},
+		{"prefer capped", "", "wait=600", 60 * time.Second, false},
+		{"prefer among others", "", "respond-async, wait=10", 10 * time.Second, false},
+		{"prefer other", "", "respond-async", 0, false},
+		{"prefer invalid", "", "wait=soon", 0, true},
+		{"query over prefer", "wait=5s", "wait=10", 5 * time.Second, false},
+		{"query over invalid prefer", "wait=5s", "wait=soon", 5 * time.Second, false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/render/pdf?"+tt.query, nil)
+		if tt.prefer != "" {
+			r.Header.Set("Prefer", tt.prefer)
+		}
+
+		got, err := parseRenderWait(r)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
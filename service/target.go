@@ -0,0 +1,300 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	boolOption    = "bool"
+	stringOption  = "string"
+	numberOption  = "number"
+	integerOption = "integer"
+	lengthOption  = "length"
+	pairsOption   = "pairs"
+)
+
+// lengthPattern is what lengths have to match e.g. '10mm'
+var lengthPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?(mm|cm|in|px)?$`)
+
+// optionRule describes the values that a target option accepts
+type optionRule struct {
+	kind   string
+	min    float64
+	max    float64
+	values []string
+}
+
+// fieldError describes why the value of a field of a request is invalid
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError is returned when fields of a request are invalid, it lists
+// all the offending fields
+type validationError struct {
+	fields []fieldError
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.fields))
+	for i, fe := range e.fields {
+		msgs[i] = fmt.Sprintf("%s %s", fe.Field, fe.Message)
+	}
+
+	return fmt.Sprintf("invalid request, %s", strings.Join(msgs, "; "))
+}
+
+var loadErrorHandlingValues = []string{"abort", "ignore", "skip"}
+
+var imageRules = map[string]optionRule{
+	"cache_dir":                 {kind: stringOption},
+	"cookie":                    {kind: pairsOption},
+	"crop_h":                    {kind: integerOption, max: math.MaxInt32},
+	"crop_w":                    {kind: integerOption, max: math.MaxInt32},
+	"crop_x":                    {kind: integerOption, max: math.MaxInt32},
+	"crop_y":                    {kind: integerOption, max: math.MaxInt32},
+	"custom_header":             {kind: pairsOption},
+	"custom_header_propagation": {kind: boolOption},
+	"debug_javascript":          {kind: boolOption},
+	"encoding":                  {kind: stringOption},
+	"format":                    {kind: stringOption, values: []string{"bmp", "jpeg", "jpg", "png", "svg"}},
+	"height":                    {kind: integerOption, max: math.MaxInt32},
+	"images":                    {kind: boolOption},
+	"javascript":                {kind: boolOption},
+	"javascript_delay":          {kind: integerOption, max: math.MaxInt32},
+	"load_error_handling":       {kind: stringOption, values: loadErrorHandlingValues},
+	"load_media_error_handling": {kind: stringOption, values: loadErrorHandlingValues},
+	"minimum_font_size":         {kind: integerOption, max: math.MaxInt32},
+	"password":                  {kind: stringOption},
+	"quality":                   {kind: integerOption, max: 100},
+	"smart_width":               {kind: boolOption},
+	"stop_slow_scripts":         {kind: boolOption},
+	"transparent":               {kind: boolOption},
+	"use_xserver":               {kind: boolOption},
+	"username":                  {kind: stringOption},
+	"width":                     {kind: integerOption, max: math.MaxInt32},
+	"zoom":                      {kind: numberOption, min: 0.01, max: 100},
+}
+
+var pdfRules = map[string]optionRule{
+	"cache_dir":                 {kind: stringOption},
+	"cookie":                    {kind: pairsOption},
+	"custom_header":             {kind: pairsOption},
+	"custom_header_propagation": {kind: boolOption},
+	"debug_javascript":          {kind: boolOption},
+	"dpi":                       {kind: integerOption, min: 1, max: 9600},
+	"encoding":                  {kind: stringOption},
+	"external_links":            {kind: boolOption},
+	"forms":                     {kind: boolOption},
+	"grayscale":                 {kind: boolOption},
+	"images":                    {kind: boolOption},
+	"image_dpi":                 {kind: integerOption, min: 1, max: 9600},
+	"image_quality":             {kind: integerOption, max: 100},
+	"internal_links":            {kind: boolOption},
+	"javascript":                {kind: boolOption},
+	"javascript_delay":          {kind: integerOption, max: math.MaxInt32},
+	"load_error_handling":       {kind: stringOption, values: loadErrorHandlingValues},
+	"load_media_error_handling": {kind: stringOption, values: loadErrorHandlingValues},
+	"lowquality":                {kind: boolOption},
+	"margin_bottom":             {kind: integerOption, max: 10000},
+	"margin_left":               {kind: integerOption, max: 10000},
+	"margin_right":              {kind: integerOption, max: 10000},
+	"margin_top":                {kind: integerOption, max: 10000},
+	"minimum_font_size":         {kind: integerOption, max: math.MaxInt32},
+	"no_pdf_compression":        {kind: boolOption},
+	"orientation":               {kind: stringOption, values: []string{"landscape", "portrait"}},
+	"page_height":               {kind: lengthOption},
+	"page_size": {kind: stringOption, values: []string{
+		"a0", "a1", "a2", "a3", "a4", "a5", "a6", "a7", "a8", "a9",
+		"b0", "b1", "b2", "b3", "b4", "b5", "b6", "b7", "b8", "b9", "b10",
+		"c5e", "comm10e", "dle", "executive", "folio", "ledger", "legal", "letter", "tabloid",
+	}},
+	"page_width":        {kind: lengthOption},
+	"password":          {kind: stringOption},
+	"smart_width":       {kind: boolOption},
+	"stop_slow_scripts": {kind: boolOption},
+	"title":             {kind: stringOption},
+	"use_xserver":       {kind: boolOption},
+	"username":          {kind: stringOption},
+	"zoom":              {kind: numberOption, min: 0.01, max: 100},
+}
+
+// checkNumber returns why the value isn't a number within the range of the
+// rule, if it isn't
+func checkNumber(v interface{}, rule optionRule, integer bool) string {
+	n, ok := v.(float64)
+	if !ok {
+		if integer {
+			return "must be an integer"
+		}
+
+		return "must be a number"
+	}
+
+	if integer && n != math.Trunc(n) {
+		return "must be an integer"
+	}
+
+	if n < rule.min || n > rule.max {
+		return fmt.Sprintf("must be between %v and %v", rule.min, rule.max)
+	}
+
+	return ""
+}
+
+// checkOption returns why the value of an option is invalid, if it is
+func checkOption(v interface{}, rule optionRule) string {
+	switch rule.kind {
+	case boolOption:
+		if _, ok := v.(bool); !ok {
+			return "must be a boolean"
+		}
+	case stringOption:
+		s, ok := v.(string)
+		if !ok {
+			return "must be a string"
+		}
+
+		if len(rule.values) == 0 {
+			return ""
+		}
+
+		for _, value := range rule.values {
+			if strings.ToLower(s) == value {
+				return ""
+			}
+		}
+
+		return fmt.Sprintf("must be one of %s", strings.Join(rule.values, ", "))
+	case numberOption:
+		return checkNumber(v, rule, false)
+	case integerOption:
+		return checkNumber(v, rule, true)
+	case lengthOption:
+		s, ok := v.(string)
+		if !ok || !lengthPattern.MatchString(s) {
+			return "must be a non-negative length e.g. 10mm"
+		}
+	case pairsOption:
+		items, ok := v.([]interface{})
+		if !ok {
+			return "must be a list of name and value pairs"
+		}
+
+		for _, item := range items {
+			pair, ok := item.(map[string]interface{})
+			if !ok {
+				return "must be a list of name and value pairs"
+			}
+
+			name, ok := pair["name"].(string)
+			if !ok || name == "" {
+				return "must have a name in each pair"
+			}
+
+			if _, ok := pair["value"].(string); !ok {
+				return "must have a string value in each pair"
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkOptions checks the options against the rules, listing an error for
+// each offending option prefixed with field. Options that apply to the whole
+// document can't be set on pages
+func checkOptions(field string, opts map[string]interface{}, specs map[string]flagSpec, rules map[string]optionRule, page bool) []fieldError {
+	var errs []fieldError
+
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		name := fmt.Sprintf("%s.%s", field, k)
+
+		spec, ok := specs[k]
+		if !ok {
+			errs = append(errs, fieldError{Field: name, Message: "is not a supported option"})
+
+			continue
+		}
+
+		if page && spec.global {
+			errs = append(errs, fieldError{Field: name, Message: "applies to the whole document, it can't be set per page"})
+
+			continue
+		}
+
+		if opts[k] == nil {
+			continue
+		}
+
+		msg := checkOption(opts[k], rules[k])
+		if msg != "" {
+			errs = append(errs, fieldError{Field: name, Message: msg})
+		}
+	}
+
+	return errs
+}
+
+// validateTarget validates the target options of a render request from its
+// JSON, before it's decoded, so that unknown options and values of the wrong
+// type are reported instead of being dropped or failing the decoding
+func validateTarget(target string, data []byte) error {
+	var (
+		specs map[string]flagSpec
+		rules map[string]optionRule
+	)
+
+	switch target {
+	case "image":
+		specs, rules = imageFlags, imageRules
+	case "pdf":
+		specs, rules = pdfFlags, pdfRules
+	default:
+		return nil
+	}
+
+	raw := struct {
+		Target map[string]interface{} `json:"target"`
+	}{}
+
+	// Leave reporting malformed JSON to decoding of the request
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil
+	}
+
+	errs := checkOptions("target", raw.Target, specs, rules, false)
+	if len(errs) > 0 {
+		return &validationError{fields: errs}
+	}
+
+	return nil
+}
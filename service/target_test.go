@@ -0,0 +1,127 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/itskingori/go-wkhtml/wkhtmltox"
+)
+
+func TestRulesMatchOptionTypes(t *testing.T) {
+	// The kinds of rules that values of each type of field can be decoded from
+	kinds := map[reflect.Kind][]string{
+		reflect.Bool:    {boolOption},
+		reflect.String:  {stringOption, lengthOption},
+		reflect.Int:     {integerOption},
+		reflect.Float64: {numberOption},
+		reflect.Slice:   {pairsOption},
+	}
+
+	tests := []struct {
+		name  string
+		opts  interface{}
+		specs map[string]flagSpec
+		rules map[string]optionRule
+	}{
+		{name: "image", opts: wkhtmltox.ImageOptions{}, specs: imageFlags, rules: imageRules},
+		{name: "pdf", opts: wkhtmltox.PDFOptions{}, specs: pdfFlags, rules: pdfRules},
+	}
+
+	for _, tt := range tests {
+		if len(tt.rules) != len(tt.specs) {
+			t.Errorf("%s: expected a rule for each of the %d options, got %d rules", tt.name, len(tt.specs), len(tt.rules))
+		}
+
+		typ := reflect.TypeOf(tt.opts)
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			key := strings.Split(field.Tag.Get("json"), ",")[0]
+			if key == "" || key == "-" {
+				continue
+			}
+
+			rule, ok := tt.rules[key]
+			if !ok {
+				t.Errorf("%s: option '%s' has no rule", tt.name, key)
+
+				continue
+			}
+
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+
+			matched := false
+			for _, kind := range kinds[ft.Kind()] {
+				if rule.kind == kind {
+					matched = true
+				}
+			}
+
+			if !matched {
+				t.Errorf("%s: option '%s' is a %s, yet its rule is of kind %s", tt.name, key, ft, rule.kind)
+			}
+		}
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		body   string
+		fields []string
+	}{
+		{target: "pdf", body: `{"target":{"margin_top":10,"page_width":"210mm","page_height":"297","zoom":1.5}}`},
+		{target: "pdf", body: `{"target":{"margin_top":"10mm"}}`, fields: []string{"target.margin_top"}},
+		{target: "pdf", body: `{"target":{"margin_left":10.5}}`, fields: []string{"target.margin_left"}},
+		{target: "pdf", body: `{"target":{"margin_bottom":10001}}`, fields: []string{"target.margin_bottom"}},
+		{target: "pdf", body: `{"target":{"page_width":210}}`, fields: []string{"target.page_width"}},
+		{target: "pdf", body: `{"target":{"page_height":"-297mm"}}`, fields: []string{"target.page_height"}},
+		{target: "pdf", body: `{"target":{"page_size":"A4","orientation":"Landscape"}}`},
+		{target: "pdf", body: `{"target":{"page_size":"A11"}}`, fields: []string{"target.page_size"}},
+		{target: "pdf", body: `{"target":{"page_sise":"A4","dpi":0}}`, fields: []string{"target.dpi", "target.page_sise"}},
+		{target: "pdf", body: `{"target":{"cookie":[{"name":"a","value":"1"}]}}`},
+		{target: "pdf", body: `{"target":{"cookie":[{"name":"","value":"1"}]}}`, fields: []string{"target.cookie"}},
+		{target: "pdf", body: `{"target":{"grayscale":"true"}}`, fields: []string{"target.grayscale"}},
+		{target: "image", body: `{"target":{"format":"png","quality":80,"crop_w":100}}`},
+		{target: "image", body: `{"target":{"format":"gif","quality":101}}`, fields: []string{"target.format", "target.quality"}},
+		{target: "image", body: `{"target":{"page_size":"A4"}}`, fields: []string{"target.page_size"}},
+		{target: "image", body: `{"target":`},
+	}
+
+	for _, tt := range tests {
+		var fields []string
+
+		err := validateTarget(tt.target, []byte(tt.body))
+		if verr, ok := err.(*validationError); ok {
+			for _, fe := range verr.fields {
+				fields = append(fields, fe.Field)
+			}
+		} else if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", tt.target, tt.body, err)
+
+			continue
+		}
+
+		if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+			t.Errorf("%s %s: expected invalid fields %v, got %v", tt.target, tt.body, tt.fields, fields)
+		}
+	}
+}
@@ -0,0 +1,387 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// templateNamePattern is what names of templates have to match e.g.
+// 'invoice-v3'
+var templateNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+// HTMLTemplate is a mapping of a stored HTML template's attributes
+type HTMLTemplate struct {
+	Name      string `redis:"name"`
+	Content   string `redis:"content"`
+	CreatedAt string `redis:"created_at"`
+	UpdatedAt string `redis:"updated_at"`
+}
+
+type templateRequest struct {
+	Content string `json:"content"`
+}
+
+type templateResponse struct {
+	Name      string `json:"name"`
+	Content   string `json:"content,omitempty"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+type templatesResponse struct {
+	Templates []string `json:"templates"`
+}
+
+func generateTemplateKey(name string) string {
+	key := fmt.Sprintf("%s:template:%s", viper.GetString("redis.namespace"), name)
+
+	return key
+}
+
+func generateTemplatesKey() string {
+	key := fmt.Sprintf("%s:templates", viper.GetString("redis.namespace"))
+
+	return key
+}
+
+func validateTemplateName(name string) error {
+	if !templateNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid template name '%s'", name)
+	}
+
+	return nil
+}
+
+func parseTemplate(name string, content string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(content)
+	if err != nil {
+		return tmpl, fmt.Errorf("invalid template: %v", err)
+	}
+
+	return tmpl, nil
+}
+
+// executeTemplate renders the named template with the data passed in
+func (clt *Client) executeTemplate(name string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	ht, found, err := clt.fetchTemplate(name)
+	if err != nil {
+		return buf.Bytes(), err
+	}
+
+	if !found {
+		return buf.Bytes(), fmt.Errorf("template '%s' not found", name)
+	}
+
+	tmpl, err := parseTemplate(name, ht.Content)
+	if err != nil {
+		return buf.Bytes(), err
+	}
+
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return buf.Bytes(), fmt.Errorf("unable to execute template '%s': %v", name, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (clt *Client) saveTemplate(ht *HTMLTemplate) (bool, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	key := generateTemplateKey(ht.Name)
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	createdAt, err := redis.String(conn.Do("HGET", key, "created_at"))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+
+	created := err == redis.ErrNil
+	if created {
+		createdAt = now
+	}
+	ht.CreatedAt = createdAt
+	ht.UpdatedAt = now
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", redis.Args{}.Add(key).AddFlat(ht)...)
+	conn.Send("SADD", generateTemplatesKey(), ht.Name)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		log.Errorf("error saving template '%s'", ht.Name)
+
+		return created, err
+	}
+
+	log.Debugf("saved template '%s'", ht.Name)
+
+	return created, nil
+}
+
+func (clt *Client) fetchTemplate(name string) (HTMLTemplate, bool, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	ht := HTMLTemplate{}
+	found := false
+
+	value, err := redis.Values(conn.Do("HGETALL", generateTemplateKey(name)))
+	if err != nil {
+		log.Errorf("unable to fetch template '%s' from redis", name)
+
+		return ht, found, err
+	}
+
+	if len(value) == 0 {
+
+		return ht, found, nil
+	}
+
+	err = redis.ScanStruct(value, &ht)
+	if err != nil {
+		log.Errorf("unable to unmarshall values to template '%s'", name)
+
+		return ht, found, err
+	}
+	found = true
+
+	return ht, found, nil
+}
+
+func (clt *Client) deleteTemplate(name string) (bool, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", generateTemplateKey(name))
+	conn.Send("SREM", generateTemplatesKey(), name)
+	values, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		log.Errorf("error deleting template '%s'", name)
+
+		return false, err
+	}
+
+	return values[0] > 0, nil
+}
+
+func (clt *Client) listTemplates() ([]string, error) {
+	conn := clt.redisPool.Get()
+	defer conn.Close()
+
+	names, err := redis.Strings(conn.Do("SMEMBERS", generateTemplatesKey()))
+	if err != nil {
+		log.Error("unable to fetch templates from redis")
+
+		return names, err
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (clt *Client) putTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		ers errorResponse
+		trq templateRequest
+	)
+
+	params := mux.Vars(r)
+	name := params["name"]
+	rid := uuid.NewV4().String()
+
+	err := validateTemplateName(name)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	err = json.NewDecoder(r.Body).Decode(&trq)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    "unable to unmarshal json to template type",
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	maxHTMLSize := viper.GetInt("server.max_html_size")
+	if len(trq.Content) > maxHTMLSize {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    fmt.Sprintf("template is %d bytes, yet the maximum is %d bytes", len(trq.Content), maxHTMLSize),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	_, err = parseTemplate(name, trq.Content)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    err.Error(),
+		}
+		requestBadRequestResponse(&w, r, ers)
+
+		return
+	}
+
+	ht := HTMLTemplate{
+		Name:    name,
+		Content: trq.Content,
+	}
+	created, err := clt.saveTemplate(&ht)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    "unable to save template",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+	log.Infof("saved template '%s'", name)
+
+	trs := templateResponse{
+		Name:      ht.Name,
+		CreatedAt: ht.CreatedAt,
+		UpdatedAt: ht.UpdatedAt,
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	requestJSONResponse(&w, r, status, trs)
+}
+
+func (clt *Client) getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	name := params["name"]
+	rid := uuid.NewV4().String()
+
+	ht, found, err := clt.fetchTemplate(name)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    "unable to fetch template",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !found {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    fmt.Sprintf("template '%s' not found", name),
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+
+	trs := templateResponse{
+		Name:      ht.Name,
+		Content:   ht.Content,
+		CreatedAt: ht.CreatedAt,
+		UpdatedAt: ht.UpdatedAt,
+	}
+	requestJSONResponse(&w, r, http.StatusOK, trs)
+}
+
+func (clt *Client) deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	params := mux.Vars(r)
+	name := params["name"]
+	rid := uuid.NewV4().String()
+
+	found, err := clt.deleteTemplate(name)
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    "unable to delete template",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	if !found {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    fmt.Sprintf("template '%s' not found", name),
+		}
+		requestNotFoundResponse(&w, r, ers)
+
+		return
+	}
+	log.Infof("deleted template '%s'", name)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (clt *Client) listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	var ers errorResponse
+
+	rid := uuid.NewV4().String()
+
+	names, err := clt.listTemplates()
+	if err != nil {
+		ers = errorResponse{
+			Identifier: rid,
+			Message:    "unable to list templates",
+		}
+		requestInternalServerErrorResponse(&w, r, ers)
+
+		return
+	}
+
+	trs := templatesResponse{Templates: names}
+	if trs.Templates == nil {
+		trs.Templates = []string{}
+	}
+	requestJSONResponse(&w, r, http.StatusOK, trs)
+}
@@ -0,0 +1,92 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestValidateTemplateName(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{"simple", "invoice", false},
+		{"punctuation", "invoice_v2.en-GB", false},
+		{"digit first", "2018-invoice", false},
+		{"longest", strings.Repeat("a", 128), false},
+		{"empty", "", true},
+		{"too long", strings.Repeat("a", 129), true},
+		{"dot first", ".invoice", true},
+		{"dash first", "-invoice", true},
+		{"slash", "invoices/2018", true},
+		{"parent", "..", true},
+		{"space", "my invoice", true},
+		{"colon", "invoice:1", true},
+	}
+
+	for _, tt := range tests {
+		err := validateTemplateName(tt.template)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		data    interface{}
+		want    string
+		wantErr bool
+	}{
+		{"plain", "<p>Hello</p>", nil, "<p>Hello</p>", false},
+		{"data", "<p>{{.name}}</p>", map[string]interface{}{"name": "Jane"}, "<p>Jane</p>", false},
+		{"escaped data", "<p>{{.name}}</p>", map[string]interface{}{"name": "<script>"}, "<p>&lt;script&gt;</p>", false},
+		{"missing key", "<p>{{.name}}</p>", map[string]interface{}{}, "<p></p>", false},
+		{"range", "{{range .items}}<li>{{.}}</li>{{end}}", map[string]interface{}{"items": []interface{}{"a", "b"}}, "<li>a</li><li>b</li>", false},
+		{"unclosed action", "<p>{{.name</p>", nil, "", true},
+		{"unclosed block", "{{if .name}}<p>", nil, "", true},
+		{"unknown function", "{{readFile \"/etc/passwd\"}}", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := parseTemplate("test", tt.content)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+
+			continue
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: got '%s', want '%s'", tt.name, buf.String(), tt.want)
+		}
+	}
+}
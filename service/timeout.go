@@ -0,0 +1,61 @@
+// Copyright © 2018 Job King'ori Maina <j@kingori.co>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// MinConversionTimeout is the minimum time that conversions can be set to
+	// run for, in seconds
+	MinConversionTimeout = 1
+
+	// MaxConversionTimeout is the maximum time that conversions can be set to
+	// run for, in seconds
+	MaxConversionTimeout = 3600
+)
+
+// validateTimeout validates the time a render request sets its conversion to
+// run for, zero means the server's default
+func validateTimeout(timeout int) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	maxTimeout := viper.GetInt("server.max_conversion_timeout")
+	if timeout < MinConversionTimeout {
+		return fmt.Errorf("set timeout is %d, yet the minimum is %d", timeout, MinConversionTimeout)
+	}
+
+	if timeout > maxTimeout {
+		return fmt.Errorf("set timeout is %d, yet the maximum is %d", timeout, maxTimeout)
+	}
+
+	return nil
+}
+
+// conversionTimeout returns how long the conversion of a render request is
+// allowed to run for, in seconds
+func conversionTimeout(rR renderRequest) int {
+	if rR.timeout() != 0 {
+		return rR.timeout()
+	}
+
+	return viper.GetInt("server.conversion_timeout")
+}
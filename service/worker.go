@@ -16,12 +16,12 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"time"
 
 	"github.com/gocraft/work"
 	"github.com/itskingori/go-wkhtml/wkhtmltox"
@@ -50,10 +50,39 @@ type workerContext struct {
 	client Client
 }
 
+// conversionError is an error at a stage of a conversion job, permanent is set
+// if retrying won't change the outcome
+type conversionError struct {
+	code      string
+	stage     string
+	err       error
+	permanent bool
+}
+
+func (e *conversionError) Error() string {
+	return e.err.Error()
+}
+
+func newConversionError(code string, stage string, err error) *conversionError {
+	return &conversionError{code: code, stage: stage, err: err}
+}
+
+// newCancelledError returns the error for a conversion job that was cancelled
+// at stage
+func newCancelledError(stage string) *conversionError {
+	cerr := newConversionError("cancelled", stage, fmt.Errorf("conversion job was cancelled"))
+	cerr.permanent = true
+
+	return cerr
+}
+
+// workerMaxAttempts returns the number of times a conversion job is attempted
+func workerMaxAttempts() int {
+	return viper.GetInt("worker.max-retries") + 1
+}
+
 func (ctx *workerContext) convert(job *work.Job) error {
 	cl := NewClient()
-	conn := cl.redisPool.Get()
-	defer conn.Close()
 
 	// Extract job parameter i.e. UUID
 	jid := job.ArgString("uuid")
@@ -62,7 +91,7 @@ func (ctx *workerContext) convert(job *work.Job) error {
 	}).Info("picked up conversion job from queue")
 
 	// Fetch all the job details
-	cj, _, err := cl.fetchConversionJob(jid)
+	cj, found, err := cl.fetchConversionJob(jid)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"uuid": jid,
@@ -71,37 +100,91 @@ func (ctx *workerContext) convert(job *work.Job) error {
 		return err
 	}
 
-	// Detect type of the conversion job
-	var rR renderRequest
-	switch cj.RequestType {
-	case "*service.imageRenderRequest":
-		rR = &imageRenderRequest{}
-	case "*service.pdfRenderRequest":
-		rR = &pdfRenderRequest{}
-	default:
+	if !found {
 		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Error("invalid render target type, won't proceed")
+			"uuid": jid,
+		}).Error("conversion job not found, won't proceed")
 
 		return nil
 	}
 
-	// Extract request details from the conversion job
-	err = json.Unmarshal(cj.RequestData, &rR)
+	// Watch for the job being cancelled while it's processed, the context is
+	// done straight away if it already was
+	jobCtx, done, err := cl.watchCancellation(jid)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Errorf("error unmarshalling request data")
+			"uuid": jid,
+		}).Errorf("error: %v", err)
 
 		return err
 	}
+	defer done()
+
+	if cj.Status == "cancelled" || jobCtx.Err() != nil {
+		log.WithFields(log.Fields{
+			"uuid": jid,
+		}).Info("conversion job cancelled, won't proceed")
+
+		return nil
+	}
+
+	cerr := cl.processConversionJob(jobCtx, &cj)
+	if cerr == nil {
+		return nil
+	}
+
+	if cerr.code == "cancelled" {
+		log.WithFields(log.Fields{
+			"uuid": cj.Identifier,
+		}).Infof("stopped conversion job while %s", cerr.stage)
+
+		// Whoever cancelled the job has usually marked it as cancelled already,
+		// along with sending the callback
+		cj.markAsCancelled()
+		err = cl.updateConversionJob(&cj)
+		if err == errJobFinished {
+			return nil
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"uuid": cj.Identifier,
+			}).Errorf("error: %v", err)
+
+			return err
+		}
+		cl.releaseBundle(&cj)
+
+		// Failing to enqueue the callback isn't worth converting again for
+		cl.enqueueCallback(&cj, 1)
+
+		return nil
+	}
+
+	// Record why the attempt failed, the job is only marked as failed once
+	// retrying is pointless or there are no more attempts left
+	jerr := jobError{
+		Code:        cerr.code,
+		Message:     cerr.Error(),
+		Stage:       cerr.stage,
+		Attempt:     int(job.Fails) + 1,
+		MaxAttempts: workerMaxAttempts(),
+	}
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
-	}).Debug("extracted request data from conversion job")
+	}).Errorf("attempt %d of %d failed while %s: %v", jerr.Attempt, jerr.MaxAttempts, jerr.Stage, cerr)
+
+	final := cerr.permanent || jerr.Attempt >= jerr.MaxAttempts
+	if final {
+		cj.markAsFailed(jerr)
+	} else {
+		cj.markAsRetrying(jerr)
+	}
 
-	// Mark conversion job in 'processing' state and save the changes
-	cj.markAsProcessing()
 	err = cl.updateConversionJob(&cj)
+	if err == errJobFinished {
+		// The job was cancelled in the meantime, there's no point retrying
+		return nil
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"uuid": cj.Identifier,
@@ -110,15 +193,62 @@ func (ctx *workerContext) convert(job *work.Job) error {
 		return err
 	}
 
+	if final {
+		cl.releaseBundle(&cj)
+
+		// Failing to enqueue the callback isn't worth converting again for
+		cl.enqueueCallback(&cj, 1)
+	}
+
+	// Retrying won't change the outcome, so don't
+	if cerr.permanent {
+		return nil
+	}
+
+	return cerr
+}
+
+// processConversionJob performs the conversion and stores the resulting file,
+// any error is returned along with the stage it happened at. It stops once ctx
+// is done, killing the conversion if it's running
+func (cl *Client) processConversionJob(ctx context.Context, cj *ConversionJob) *conversionError {
+	// Extract request details from the conversion job
+	rR, err := cj.renderRequest()
+	if err != nil {
+		cerr := newConversionError("invalid_request", "preparing", err)
+		cerr.permanent = true
+
+		return cerr
+	}
+	log.WithFields(log.Fields{
+		"uuid": cj.Identifier,
+	}).Debug("extracted request data from conversion job")
+
+	// Mark conversion job in 'processing' state and save the changes
+	cj.markAsProcessing()
+	err = cl.updateConversionJob(cj)
+	if err == errJobFinished {
+		return newCancelledError("preparing")
+	}
+	if err != nil {
+		return newConversionError("internal_error", "preparing", err)
+	}
+
+	// Check the sources again in case what their hosts resolve to has changed
+	// since the request was made, retrying won't change the outcome
+	err = cl.checkSources(rR)
+	if err != nil {
+		cerr := newConversionError("source_not_allowed", "preparing", err)
+		cerr.permanent = true
+
+		return cerr
+	}
+
 	// Prepare conversion working directory, this is where we'll save the
 	// resulting file before we upload it
 	outputDir, err := ioutil.TempDir("", cj.Identifier)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Errorf("error: %v", err)
-
-		return err
+		return newConversionError("internal_error", "preparing", err)
 	}
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
@@ -127,63 +257,93 @@ func (ctx *workerContext) convert(job *work.Job) error {
 	// Make sure we remove any generated files after we're done
 	defer os.RemoveAll(outputDir)
 
-	// Fulfill render request (perform actual conversion)
+	// Fulfill render request (perform actual conversion), the logs are kept
+	// even if it fails since they explain why. Jobs saved before timeouts were
+	// introduced don't have one
+	convertCtx := ctx
+	if cj.Timeout > 0 {
+		var cancel context.CancelFunc
+		convertCtx, cancel = context.WithTimeout(ctx, time.Duration(cj.Timeout)*time.Second)
+		defer cancel()
+	}
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
-	}).Info("start conversion process")
-	outputLogs, outputFile, err := rR.fulfill(&cl, &cj, outputDir)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Errorf("error: %v", err)
+	}).Infof("start conversion process, timing out after %d seconds", cj.Timeout)
+	outputLogs, outputFile, err := rR.fulfill(convertCtx, cl, cj, outputDir)
+	cj.Logs = outputLogs
+	if ctx.Err() != nil {
+		return newCancelledError("converting")
+	}
+	if convertCtx.Err() == context.DeadlineExceeded {
+		// Runaway scripts or hung assets would only time out again
+		cerr := newConversionError("timeout", "converting", fmt.Errorf("conversion timed out after %d seconds", cj.Timeout))
+		cerr.permanent = true
 
-		return err
+		return cerr
+	}
+	if err != nil {
+		return newConversionError("conversion_failed", "converting", err)
 	}
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
 	}).Info("completed conversion process")
 
+	cl.releaseBundle(cj)
+
 	// Update conversion job with results
-	cj.Logs = outputLogs
 	log.WithFields(log.Fields{
 		"uuid": cj.Identifier,
 	}).Debug("updated conversion job with logs")
-	err = cl.updateConversionJob(&cj)
+	err = cl.updateConversionJob(cj)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Errorf("error: %v", err)
+		return newConversionError("internal_error", "converting", err)
+	}
 
-		return err
+	if ctx.Err() != nil {
+		return newCancelledError("storing")
 	}
 
-	// Upload the generated file to S3
-	cj.StorageBucket = viper.GetString("worker.s3_bucket")
-	cj.StorageKey = fmt.Sprintf("%s/%s", cj.Identifier, filepath.Base(outputFile))
-	err = cl.storeFileS3(&cj, outputFile)
+	// Store the generated file
+	out := rR.outputOptions()
+	name := generateStorageFilename(out, outputFile)
+	obj := generateStorageObject(cj, out, outputFile, name)
+	container, prefix := splitStorageDestination(out.Destination)
+	key, err := generateStorageKey(out.KeyTemplate, prefix, newStorageKeyData(cj, name))
 	if err != nil {
-		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Errorf("error: %v", err)
+		cerr := newConversionError("invalid_output", "storing", err)
+		cerr.permanent = true
 
-		return err
+		return cerr
 	}
-
-	// Update conversion job status and save the changes
+	cj.StorageLocation, err = cl.storage.Put(cj, container, key, outputFile, obj)
 	if err != nil {
-		cj.markAsFailed()
-	} else {
-		cj.markAsSucceeded()
+		return newConversionError("storage_failed", "storing", err)
 	}
-	err = cl.updateConversionJob(&cj)
+
+	// Keep track of the stored file so that it's cleaned up when the job expires
+	err = cl.trackStoredFile(cj)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"uuid": cj.Identifier,
-		}).Errorf("error: %v", err)
+		return newConversionError("internal_error", "storing", err)
+	}
 
-		return err
+	if ctx.Err() != nil {
+		return newCancelledError("storing")
+	}
+
+	// Update conversion job status and save the changes
+	cj.markAsSucceeded()
+	err = cl.updateConversionJob(cj)
+	if err == errJobFinished {
+		return newCancelledError("storing")
+	}
+	if err != nil {
+		return newConversionError("internal_error", "storing", err)
 	}
 
+	// Let the client know that the job is done, failing to enqueue the callback
+	// isn't worth converting again for
+	cl.enqueueCallback(cj, 1)
+
 	return nil
 }
 
@@ -192,6 +352,8 @@ func (c *Client) StartWorker() {
 	concurrency := viper.GetSizeInBytes("worker.concurrency")
 	maxRetries := viper.GetSizeInBytes("worker.max-retries")
 	namespace := viper.GetString("redis.namespace")
+	storage := viper.GetString("storage.backend")
+	cleanupSchedule := viper.GetString("worker.cleanup_schedule")
 
 	// Check for wkhtmltoimage installation
 	_, version, erri := wkhtmltox.LookupConverter("wkhtmltoimage")
@@ -210,8 +372,16 @@ func (c *Client) StartWorker() {
 	if erri != nil && errp != nil {
 		log.Errorln("will not start workers due to errors")
 	} else {
+		proxyURL, err := startSourceProxy(c.sourcePolicy)
+		if err != nil {
+			log.Fatalf("unable to start source proxy: %v", err)
+		}
+		sourceProxyURL = proxyURL
+		log.Infof("applying source policy to conversions via proxy on %s", proxyURL)
+
 		log.Infof("concurrency set to %d", concurrency)
 		log.Infof("maximum retries set to %d", maxRetries)
+		log.Infof("storing rendered files using the %s backend", storage)
 		pool := work.NewWorkerPool(workerContext{}, concurrency, namespace, c.redisPool)
 
 		// Set job options
@@ -222,6 +392,15 @@ func (c *Client) StartWorker() {
 		log.Infof("registering '%s' queue", conversionQueue)
 		pool.JobWithOptions(conversionQueue, jobOptions, (*workerContext).convert)
 
+		log.Infof("registering '%s' queue", archiveQueue)
+		pool.JobWithOptions(archiveQueue, jobOptions, (*workerContext).archive)
+
+		// Periodically clean up stored files of expired jobs, the worker pools
+		// coordinate so that this is only enqueued once per schedule
+		log.Infof("registering '%s' queue on schedule '%s'", cleanupQueue, cleanupSchedule)
+		pool.Job(cleanupQueue, (*workerContext).cleanup)
+		pool.PeriodicallyEnqueue(cleanupSchedule, cleanupQueue)
+
 		// Start processing jobs
 		log.Infof("waiting to pick up jobs placed on any registered queue")
 		pool.Start()